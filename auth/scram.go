@@ -0,0 +1,189 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Mechanism names negotiated during saslStart.
+const (
+	MechanismSCRAMSHA1   = "SCRAM-SHA-1"
+	MechanismSCRAMSHA256 = "SCRAM-SHA-256"
+)
+
+var errScramServer = errors.New("auth: malformed SCRAM server message")
+
+// scramConversation drives one SCRAM-SHA-1/SCRAM-SHA-256 login (RFC
+// 5802) over whatever transport Authenticate uses to exchange saslStart
+// and saslContinue payloads.
+type scramConversation struct {
+	mechanism    string
+	username     string
+	password     string
+	clientNonce  string
+	clientFirst  string // bare, i.e. without the "n,," GS2 header
+	authMessage  string
+	saltedPasswd []byte
+}
+
+// clientNonce generates the random "r" value sent in the client-first-message.
+func clientNonce() string {
+	b := make([]byte, 24)
+	if _, e := rand.Read(b); e != nil {
+		panic(e) // crypto/rand failing means the system RNG is broken
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func newScramConversation(mechanism, username, password, clientNonce string) *scramConversation {
+	return &scramConversation{
+		mechanism:   mechanism,
+		username:    username,
+		password:    password,
+		clientNonce: clientNonce,
+	}
+}
+
+func (c *scramConversation) newHash() func() hash.Hash {
+	if c.mechanism == MechanismSCRAMSHA1 {
+		return sha1.New
+	}
+	return sha256.New
+}
+
+// preppedPassword applies the mechanism-specific password transform:
+// SCRAM-SHA-1 hashes with the legacy MONGODB-CR digest for backwards
+// compatibility; SCRAM-SHA-256 uses the password as-is (full SASLprep
+// normalization is not implemented -- this covers plain-ASCII passwords).
+func (c *scramConversation) preppedPassword() string {
+	if c.mechanism == MechanismSCRAMSHA1 {
+		sum := md5.Sum([]byte(c.username + ":mongo:" + c.password))
+		return hex.EncodeToString(sum[:])
+	}
+	return c.password
+}
+
+// firstMessage returns the client-first-message to send as saslStart's
+// payload.
+func (c *scramConversation) firstMessage() string {
+	c.clientFirst = fmt.Sprintf("n=%s,r=%s", escapeSaslName(c.username), c.clientNonce)
+	return "n,," + c.clientFirst
+}
+
+// finalMessage parses the server-first-message (serverFirst) and returns
+// the client-final-message to send as saslContinue's payload.
+func (c *scramConversation) finalMessage(serverFirst string) (string, error) {
+	fields, e := parseScram(serverFirst)
+	if e != nil {
+		return "", e
+	}
+
+	nonce, salt, iterStr := fields["r"], fields["s"], fields["i"]
+	if nonce == "" || salt == "" || iterStr == "" || !strings.HasPrefix(nonce, c.clientNonce) {
+		return "", errScramServer
+	}
+
+	iterations, e := strconv.Atoi(iterStr)
+	if e != nil {
+		return "", errScramServer
+	}
+
+	saltBytes, e := base64.StdEncoding.DecodeString(salt)
+	if e != nil {
+		return "", errScramServer
+	}
+
+	newHash := c.newHash()
+	c.saltedPasswd = pbkdf2.Key([]byte(c.preppedPassword()), saltBytes, iterations, newHash().Size(), newHash)
+
+	withoutProof := "c=biws,r=" + nonce // "biws" is base64("n,,"), the GS2 header again
+	c.authMessage = c.clientFirst + "," + serverFirst + "," + withoutProof
+
+	clientKey := hmacSum(newHash, c.saltedPasswd, "Client Key")
+	storedKey := hashSum(newHash, clientKey)
+	clientSignature := hmacSum(newHash, storedKey, c.authMessage)
+	clientProof := xorBytes(clientKey, clientSignature)
+
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientProof), nil
+}
+
+// verifyServerFinal checks the server-final-message's signature against
+// the one we independently derived, so the proxy doesn't trust a
+// man-in-the-middled upstream.
+func (c *scramConversation) verifyServerFinal(serverFinal string) error {
+	fields, e := parseScram(serverFinal)
+	if e != nil {
+		return e
+	}
+
+	v := fields["v"]
+	if v == "" {
+		if errmsg := fields["e"]; errmsg != "" {
+			return errors.New("auth: upstream rejected credentials: " + errmsg)
+		}
+		return errScramServer
+	}
+
+	newHash := c.newHash()
+	serverKey := hmacSum(newHash, c.saltedPasswd, "Server Key")
+	serverSignature := hmacSum(newHash, serverKey, c.authMessage)
+
+	if v != base64.StdEncoding.EncodeToString(serverSignature) {
+		return errors.New("auth: server signature mismatch, possible MITM")
+	}
+
+	return nil
+}
+
+func hmacSum(newHash func() hash.Hash, key []byte, msg string) []byte {
+	m := hmac.New(newHash, key)
+	m.Write([]byte(msg))
+	return m.Sum(nil)
+}
+
+func hashSum(newHash func() hash.Hash, data []byte) []byte {
+	h := newHash()
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func xorBytes(a, b []byte) []byte {
+	out := make([]byte, len(a))
+	for i := range a {
+		out[i] = a[i] ^ b[i]
+	}
+	return out
+}
+
+// escapeSaslName escapes "=" and "," per RFC 5802 section 5.1.
+func escapeSaslName(s string) string {
+	s = strings.ReplaceAll(s, "=", "=3D")
+	s = strings.ReplaceAll(s, ",", "=2C")
+	return s
+}
+
+// parseScram splits a SCRAM message like "r=nonce,s=salt,i=4096" into a
+// key/value map.
+func parseScram(msg string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for _, part := range strings.Split(msg, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, errScramServer
+		}
+		fields[kv[0]] = kv[1]
+	}
+	return fields, nil
+}
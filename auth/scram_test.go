@@ -0,0 +1,76 @@
+package auth
+
+import "testing"
+
+// TestScramSHA256Conversation drives a full SCRAM-SHA-256 (RFC 5802/7677)
+// conversation against the RFC 7677 worked example, so firstMessage,
+// finalMessage and verifyServerFinal are checked against known-good wire
+// values rather than just round-tripping against themselves.
+func TestScramSHA256Conversation(t *testing.T) {
+	const (
+		serverFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+		wantFirst   = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+		wantFinal   = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+		serverFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+	)
+
+	c := newScramConversation(MechanismSCRAMSHA256, "user", "pencil", "rOprNGfwEbeRWgbNEkqO")
+
+	if got := c.firstMessage(); got != wantFirst {
+		t.Fatalf("firstMessage() = %q, want %q", got, wantFirst)
+	}
+
+	got, e := c.finalMessage(serverFirst)
+	if e != nil {
+		t.Fatalf("finalMessage: %v", e)
+	}
+	if got != wantFinal {
+		t.Fatalf("finalMessage() = %q, want %q", got, wantFinal)
+	}
+
+	if e := c.verifyServerFinal(serverFinal); e != nil {
+		t.Fatalf("verifyServerFinal: %v", e)
+	}
+}
+
+// TestScramVerifyServerFinalRejectsBadSignature makes sure a tampered (or
+// MITM'd) server-final-message is rejected rather than silently accepted.
+func TestScramVerifyServerFinalRejectsBadSignature(t *testing.T) {
+	const serverFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+
+	c := newScramConversation(MechanismSCRAMSHA256, "user", "pencil", "rOprNGfwEbeRWgbNEkqO")
+	c.firstMessage()
+	if _, e := c.finalMessage(serverFirst); e != nil {
+		t.Fatalf("finalMessage: %v", e)
+	}
+
+	if e := c.verifyServerFinal("v=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="); e == nil {
+		t.Fatal("verifyServerFinal accepted a forged server signature")
+	}
+}
+
+// TestScramFinalMessageRejectsNonceMismatch guards against a server that
+// doesn't echo back our client nonce, which would let a different
+// conversation's response be spliced in.
+func TestScramFinalMessageRejectsNonceMismatch(t *testing.T) {
+	c := newScramConversation(MechanismSCRAMSHA256, "user", "pencil", "rOprNGfwEbeRWgbNEkqO")
+	c.firstMessage()
+
+	_, e := c.finalMessage("r=someoneElsesNonce,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if e != errScramServer {
+		t.Fatalf("got err %v, want errScramServer", e)
+	}
+}
+
+// TestScramSHA1PreppedPassword checks SCRAM-SHA-1's MONGODB-CR-compatible
+// password digest, the one place SCRAM-SHA-1 and SCRAM-SHA-256 diverge in
+// this package.
+func TestScramSHA1PreppedPassword(t *testing.T) {
+	c := newScramConversation(MechanismSCRAMSHA1, "user", "pencil", "clientnonce")
+
+	// md5("user:mongo:pencil")
+	const want = "1c33006ec1ffd90f9cadcbcc0e118200"
+	if got := c.preppedPassword(); got != want {
+		t.Fatalf("preppedPassword() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"context"
+
+	mp "github.com/julianshen/mongoproxy"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var clientAuthCommands = map[string]bool{
+	"saslStart":    true,
+	"saslContinue": true,
+	"authenticate": true,
+	"logout":       true,
+}
+
+// SpoofClientAuth returns an Interceptor that answers a client's own
+// saslStart/saslContinue/authenticate/logout commands with an immediate
+// fabricated success, instead of forwarding them upstream. It's meant to
+// pair with Proxy.UpstreamAuth: the proxy authenticates the upstream
+// connection itself with its own Credentials, so clients can connect
+// without presenting (or knowing) real ones.
+func SpoofClientAuth() mp.Interceptor {
+	return func(ctx context.Context, req mp.RequestMsg) (mp.RequestMsg, mp.RequestMsg, error) {
+		_, command := mp.Namespace(req)
+		if !clientAuthCommands[command] {
+			return req, nil, nil
+		}
+
+		return req, okReply(req), nil
+	}
+}
+
+// okReply builds a generic successful-sasl-conversation document, shaped
+// to match req (see mp.NewReply) -- saslStart/saslContinue from any
+// current driver arrive over OP_MSG, not the legacy OP_REPLY, and this
+// is meant to stand in for exactly that handshake.
+func okReply(req mp.RequestMsg) mp.RequestMsg {
+	doc := bson.D{
+		{Name: "conversationId", Value: int32(1)},
+		{Name: "done", Value: true},
+		{Name: "payload", Value: []byte{}},
+		{Name: "ok", Value: float64(1)},
+	}
+
+	return mp.NewReply(req, doc)
+}
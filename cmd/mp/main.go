@@ -1,7 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"time"
+
 	mp "github.com/julianshen/mongoproxy"
+	"github.com/julianshen/mongoproxy/auth"
+	"github.com/julianshen/mongoproxy/interceptor"
+	"github.com/julianshen/mongoproxy/metrics"
+	"github.com/julianshen/mongoproxy/pool"
+	"github.com/julianshen/mongoproxy/recorder"
 	flag "github.com/ogier/pflag"
 )
 
@@ -9,17 +19,164 @@ var (
 	dstHost           string
 	port              int
 	shouldLogResponse bool
+	recordFile        string
+	replayFile        string
+	speed             float64
+	metricsAddr       string
+	denyCommands      string
+	routesFile        string
+
+	tlsCert       string
+	tlsKey        string
+	tlsClientCA   string
+	upstreamTLSCA string
+	upstreamSNI   string
+
+	authUsername  string
+	authPassword  string
+	authSource    string
+	authMechanism string
+
+	poolSeeds        string
+	poolMinSize      int
+	poolMaxSize      int
+	poolIdleTimeout  time.Duration
+	poolPollInterval time.Duration
+	readPreference   string
 )
 
 func init() {
 	flag.StringVar(&dstHost, "remote", "localhost:27017", "Remote host name and port of the Mongodb (default localhost:port)")
 	flag.IntVar(&port, "port", 50001, "Local proxy port (default 50001)")
 	flag.BoolVar(&shouldLogResponse, "response", false, "Log response")
+	flag.StringVar(&recordFile, "record", "", "Capture proxied traffic to this BSON file for later replay")
+	flag.StringVar(&replayFile, "replay", "", "Replay a -record capture file against -remote instead of proxying")
+	flag.Float64Var(&speed, "speed", 1, "Playback speed multiplier when replaying (default 1x)")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Serve Prometheus metrics on this address (e.g. :9090); disabled if empty")
+	flag.StringVar(&denyCommands, "deny", "", "Comma-separated commands to reject with a fabricated error (e.g. dropDatabase,eval)")
+	flag.StringVar(&routesFile, "routes", "", "YAML file of namespace routing rules; see interceptor.LoadRouter")
+
+	flag.StringVar(&tlsCert, "tls-cert", "", "Certificate file for terminating client TLS; disabled if empty")
+	flag.StringVar(&tlsKey, "tls-key", "", "Private key file for -tls-cert")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "CA file to require and verify client certificates against")
+	flag.StringVar(&upstreamTLSCA, "upstream-tls-ca", "", "CA file to trust for -remote's certificate instead of the system roots; set to enable upstream TLS")
+	flag.StringVar(&upstreamSNI, "upstream-tls-server-name", "", "Server name to verify -remote's certificate against (SNI), if different from -remote's host")
+
+	flag.StringVar(&authUsername, "upstream-user", "", "Username mongoproxy authenticates to -remote with; disabled if empty")
+	flag.StringVar(&authPassword, "upstream-password", "", "Password for -upstream-user")
+	flag.StringVar(&authSource, "upstream-auth-source", "admin", "Authentication database for -upstream-user")
+	flag.StringVar(&authMechanism, "upstream-auth-mechanism", auth.MechanismSCRAMSHA256, "SCRAM mechanism for -upstream-user: SCRAM-SHA-1 or SCRAM-SHA-256")
+
+	flag.StringVar(&poolSeeds, "pool-seeds", "", "Comma-separated replica set seed host:port list; set to route across a replica set instead of dialing -remote once per client")
+	flag.IntVar(&poolMinSize, "pool-min-size", 0, "Passed to the pool as MinSize, which the pool stores but does not act on")
+	flag.IntVar(&poolMaxSize, "pool-max-size", 10, "Connections per server the pool allows checked out at once; 0 means unbounded")
+	flag.DurationVar(&poolIdleTimeout, "pool-idle-timeout", 5*time.Minute, "Idle connections older than this are closed instead of reused")
+	flag.DurationVar(&poolPollInterval, "pool-poll-interval", 10*time.Second, "How often the topology monitor re-sends hello to known servers")
+	flag.StringVar(&readPreference, "read-preference", string(pool.Primary), "Read preference when -pool-seeds is set: primary, primaryPreferred, secondary, or nearest")
 	flag.Parse()
 }
 
 func main() {
+	if metricsAddr != "" {
+		go func() {
+			if e := metrics.Serve(metricsAddr); e != nil {
+				panic(e)
+			}
+		}()
+	}
+
+	if replayFile != "" {
+		replayer := recorder.Replayer{Target: dstHost, Speed: speed}
+		e := replayer.Replay(replayFile)
+
+		if e != nil {
+			panic(e)
+		}
+		return
+	}
+
 	proxy := mp.Proxy{Remote: dstHost, Port: port, LogResp: shouldLogResponse}
+
+	if tlsCert != "" {
+		tlsConfig, e := mp.LoadServerTLSConfig(tlsCert, tlsKey, tlsClientCA)
+		if e != nil {
+			panic(e)
+		}
+		proxy.TLSConfig = tlsConfig
+	}
+
+	if upstreamTLSCA != "" || upstreamSNI != "" {
+		tlsConfig, e := mp.LoadUpstreamTLSConfig(upstreamTLSCA, upstreamSNI)
+		if e != nil {
+			panic(e)
+		}
+		proxy.UpstreamTLSConfig = tlsConfig
+	}
+
+	if authUsername != "" {
+		proxy.UpstreamAuth = &auth.Credentials{
+			Username:  authUsername,
+			Password:  authPassword,
+			Source:    authSource,
+			Mechanism: authMechanism,
+		}
+		proxy.Interceptors = append(proxy.Interceptors, auth.SpoofClientAuth())
+	}
+
+	if poolSeeds != "" {
+		dial := func(addr string) (net.Conn, error) {
+			var conn net.Conn
+			var e error
+			if proxy.UpstreamTLSConfig != nil {
+				conn, e = tls.Dial("tcp", addr, proxy.UpstreamTLSConfig)
+			} else {
+				conn, e = net.Dial("tcp", addr)
+			}
+			if e != nil {
+				return nil, e
+			}
+
+			if proxy.UpstreamAuth != nil {
+				if e := proxy.UpstreamAuth.Authenticate(conn); e != nil {
+					conn.Close()
+					return nil, e
+				}
+			}
+
+			return conn, nil
+		}
+
+		seeds := strings.Split(poolSeeds, ",")
+		topology := pool.NewTopology(dial, seeds, poolPollInterval)
+		go topology.Start()
+
+		proxy.Pool = pool.New(dial, poolMinSize, poolMaxSize, poolIdleTimeout)
+		proxy.Topology = topology
+		proxy.ReadPreference = pool.ReadPreference(readPreference)
+	}
+
+	if routesFile != "" {
+		router, e := interceptor.LoadRouter(routesFile)
+		if e != nil {
+			panic(e)
+		}
+		proxy.Interceptors = append(proxy.Interceptors, router.Intercept)
+	}
+
+	if denyCommands != "" {
+		proxy.Interceptors = append(proxy.Interceptors, interceptor.DenyList(strings.Split(denyCommands, ",")...))
+	}
+
+	if recordFile != "" {
+		capture, e := recorder.NewCaptureSink(recordFile)
+		if e != nil {
+			panic(e)
+		}
+		defer capture.Close()
+
+		proxy.Sink = &mp.FanOutSink{Sinks: []mp.Sink{&mp.JSONLogSink{LogResponse: shouldLogResponse}, capture}}
+	}
+
 	e := proxy.Start()
 
     if e != nil {
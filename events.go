@@ -0,0 +1,240 @@
+package mongoproxy
+
+import (
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// OpEvent is the structured record emitted once per proxied op. RequestID
+// is the request's header RequestID; Reply summarizes the next message
+// read back from upstream after the request is written, whose ResponseTo
+// is not checked against RequestID.
+type OpEvent struct {
+	RequestID        int32
+	Op               string
+	NS               string
+	Command          string
+	DurationParse    time.Duration
+	DurationUpstream time.Duration
+	DurationTotal    time.Duration
+	Reply            *ReplySummary `json:",omitempty"`
+}
+
+// ReplySummary is the part of OpEvent describing the upstream reply.
+type ReplySummary struct {
+	CursorID  int64
+	NReturned int32
+	OK        bool
+	ErrMsg    string
+}
+
+// Namespace extracts the namespace ("db.collection") and logical command name
+// a request targets, for use in OpEvent and metrics labels.
+func Namespace(r RequestMsg) (ns string, command string) {
+	switch t := r.(type) {
+	case *Query:
+		ns = t.FullCollectionName
+		if len(t.Query) > 0 {
+			command = t.Query[0].Name
+		}
+	case *Insert:
+		ns, command = t.FullCollectionName, "insert"
+	case *Update:
+		ns, command = t.FullCollectionName, "update"
+	case *Delete:
+		ns, command = t.FullCollectionName, "delete"
+	case *GetMore:
+		ns, command = t.FullCollectionName, "getMore"
+	case *KillCursors:
+		command = "killCursors"
+	case *OpMsg:
+		db := ""
+		command, db = t.Command()
+		ns = db
+
+		for _, s := range t.Sections {
+			body, ok := s.(BodySection)
+			if !ok || len(body.Document) == 0 {
+				continue
+			}
+
+			if coll, ok := body.Document[0].Value.(string); ok && db != "" {
+				ns = db + "." + coll
+			}
+			break
+		}
+	case *Compressed:
+		return Namespace(t.Inner)
+	}
+
+	return
+}
+
+// replySummary peeks an upstream reply for the fields operators care
+// about: whether it succeeded, any error message, and cursor info.
+func replySummary(r RequestMsg) *ReplySummary {
+	switch t := r.(type) {
+	case *Reply:
+		s := &ReplySummary{CursorID: t.CursorID, NReturned: t.NumberReturned, OK: true}
+		if len(t.Documents) > 0 {
+			readReplyFields(t.Documents[0], s)
+		}
+		return s
+	case *OpMsg:
+		s := &ReplySummary{OK: true}
+		for _, sec := range t.Sections {
+			if body, ok := sec.(BodySection); ok {
+				readReplyFields(body.Document, s)
+			}
+		}
+		return s
+	case *Compressed:
+		return replySummary(t.Inner)
+	}
+
+	return nil
+}
+
+func readReplyFields(doc bson.D, s *ReplySummary) {
+	for _, e := range doc {
+		switch e.Name {
+		case "ok":
+			s.OK = truthy(e.Value)
+		case "errmsg":
+			if m, ok := e.Value.(string); ok {
+				s.ErrMsg = m
+			}
+		case "cursor":
+			if cur, ok := e.Value.(bson.D); ok {
+				readCursorFields(cur, s)
+			}
+		}
+	}
+}
+
+func readCursorFields(cur bson.D, s *ReplySummary) {
+	for _, e := range cur {
+		switch e.Name {
+		case "id":
+			if id, ok := e.Value.(int64); ok {
+				s.CursorID = id
+			}
+		case "firstBatch", "nextBatch":
+			if batch, ok := e.Value.([]interface{}); ok {
+				s.NReturned = int32(len(batch))
+			}
+		}
+	}
+}
+
+func truthy(v interface{}) bool {
+	switch n := v.(type) {
+	case bool:
+		return n
+	case int32:
+		return n != 0
+	case int64:
+		return n != 0
+	case float64:
+		return n != 0
+	}
+	return false
+}
+
+// cursorLocation is what cursorTracker remembers about one outstanding
+// cursor: the namespace it was opened against, and -- when the proxy is
+// routing across a replica set -- the upstream server that returned it,
+// since get-mores and kill-cursors must be pinned back to that same
+// server.
+type cursorLocation struct {
+	ns     string
+	server string
+}
+
+// cursorTracker remembers where each outstanding cursor came from, so
+// kill-cursors -- which carry no namespace on the wire -- can be tied back
+// to the query's namespace, and get-mores and kill-cursors -- which carry
+// no server hint -- can be pinned to the server that returned the cursor.
+type cursorTracker struct {
+	locations map[int64]cursorLocation
+}
+
+func newCursorTracker() *cursorTracker {
+	return &cursorTracker{locations: make(map[int64]cursorLocation)}
+}
+
+// observe records the cursor opened by reply (if any), tagged with the
+// server it came from, and forgets any cursors closed by req.
+func (c *cursorTracker) observe(req RequestMsg, ns, server string, reply *ReplySummary) {
+	if reply != nil && reply.CursorID != 0 {
+		c.locations[reply.CursorID] = cursorLocation{ns: ns, server: server}
+	}
+
+	if kc, ok := req.(*KillCursors); ok {
+		for _, id := range kc.CursorIDs {
+			delete(c.locations, id)
+		}
+	}
+}
+
+// lookup returns the namespace and pinned server for cursorID, if known.
+func (c *cursorTracker) lookup(cursorID int64) (ns, server string) {
+	loc := c.locations[cursorID]
+	return loc.ns, loc.server
+}
+
+// NewReply builds a synthesized reply carrying doc, addressed back at
+// req and shaped to match how req arrived on the wire: an OpMsg (with a
+// single BodySection) if req is *OpMsg, or *Compressed wrapping one,
+// else a legacy OP_REPLY. It's meant for interceptors that short-circuit
+// a request without contacting upstream -- a modern driver that sent its
+// command over OP_MSG won't accept a legacy OP_REPLY back.
+func NewReply(req RequestMsg, doc bson.D) RequestMsg {
+	header := req.GetHeader()
+
+	if isOpMsgShaped(req) {
+		return &OpMsg{
+			MsgHeader: &MsgHeader{
+				RequestID:  header.RequestID + 1,
+				ResponseTo: header.RequestID,
+				Opcode:     OP_MSG_2013,
+			},
+			Sections: []Section{BodySection{Document: doc}},
+		}
+	}
+
+	b, _ := bson.Marshal(doc)
+	length := HEADER_SIZE + 4 + 8 + 4 + 4 + len(b)
+
+	return &Reply{
+		MsgHeader: &MsgHeader{
+			MessageLength: int32(length),
+			RequestID:     header.RequestID + 1,
+			ResponseTo:    header.RequestID,
+			Opcode:        OP_REPLY,
+		},
+		NumberReturned: 1,
+		Documents:      []bson.D{doc},
+	}
+}
+
+// isOpMsgShaped reports whether req arrived as an OpMsg, possibly
+// wrapped in OP_COMPRESSED.
+func isOpMsgShaped(req RequestMsg) bool {
+	switch t := req.(type) {
+	case *OpMsg:
+		return true
+	case *Compressed:
+		return isOpMsgShaped(t.Inner)
+	}
+	return false
+}
+
+// NewErrorReply builds a short-circuit reply carrying a command error
+// document ({ok: 0, errmsg: msg}), shaped to match req (see NewReply).
+// It's meant for interceptors that short-circuit a request without
+// contacting upstream.
+func NewErrorReply(req RequestMsg, msg string) RequestMsg {
+	return NewReply(req, bson.D{{Name: "ok", Value: float64(0)}, {Name: "errmsg", Value: msg}})
+}
@@ -0,0 +1,30 @@
+// Package interceptor ships built-in mongoproxy.Interceptors: namespace
+// routing, query rewriting, and a command deny-list.
+package interceptor
+
+import (
+	"context"
+	"fmt"
+
+	mp "github.com/julianshen/mongoproxy"
+)
+
+// DenyList returns an Interceptor that short-circuits any request whose
+// command is one of commands (e.g. "dropDatabase", "eval"), replying with
+// a fabricated command-error document instead of forwarding it upstream.
+func DenyList(commands ...string) mp.Interceptor {
+	denied := make(map[string]bool, len(commands))
+	for _, c := range commands {
+		denied[c] = true
+	}
+
+	return func(ctx context.Context, req mp.RequestMsg) (mp.RequestMsg, mp.RequestMsg, error) {
+		_, command := mp.Namespace(req)
+		if !denied[command] {
+			return req, nil, nil
+		}
+
+		msg := fmt.Sprintf("command %q is not allowed through this proxy", command)
+		return req, mp.NewErrorReply(req, msg), nil
+	}
+}
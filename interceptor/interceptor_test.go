@@ -0,0 +1,211 @@
+package interceptor
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	mp "github.com/julianshen/mongoproxy"
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestRewriteQuery(t *testing.T) {
+	r := Rewrite{MaxTimeMS: 5000}
+
+	q := &mp.Query{
+		MsgHeader: &mp.MsgHeader{RequestID: 1, Opcode: mp.OP_QUERY},
+		Query:     bson.D{{Name: "ping", Value: 1}},
+	}
+
+	_, reply, e := r.Intercept(context.Background(), q)
+	if e != nil || reply != nil {
+		t.Fatalf("Intercept() = %v, %v, want pass-through", reply, e)
+	}
+
+	if !hasKey(q.Query, "maxTimeMS") {
+		t.Errorf("Query = %v, want maxTimeMS injected", q.Query)
+	}
+}
+
+func TestRewriteDoesNotOverwriteExisting(t *testing.T) {
+	r := Rewrite{MaxTimeMS: 5000}
+
+	q := &mp.Query{
+		MsgHeader: &mp.MsgHeader{RequestID: 1, Opcode: mp.OP_QUERY},
+		Query:     bson.D{{Name: "ping", Value: 1}, {Name: "maxTimeMS", Value: int32(1)}},
+	}
+
+	r.Intercept(context.Background(), q)
+
+	var got int
+	for _, e := range q.Query {
+		if e.Name == "maxTimeMS" {
+			got++
+		}
+	}
+	if got != 1 {
+		t.Errorf("maxTimeMS appears %d times, want 1", got)
+	}
+}
+
+func TestRewriteOpMsg(t *testing.T) {
+	r := Rewrite{ReadPreference: bson.D{{Name: "mode", Value: "secondary"}}}
+
+	m := &mp.OpMsg{
+		MsgHeader: &mp.MsgHeader{RequestID: 1, Opcode: mp.OP_MSG_2013},
+		Sections: []mp.Section{
+			mp.BodySection{Document: bson.D{{Name: "find", Value: "coll"}}},
+		},
+	}
+
+	r.Intercept(context.Background(), m)
+
+	body := m.Sections[0].(mp.BodySection).Document
+	if !hasKey(body, "$readPreference") {
+		t.Errorf("Document = %v, want $readPreference injected", body)
+	}
+}
+
+func TestDenyListBlocksMatchingCommand(t *testing.T) {
+	deny := DenyList("dropDatabase")
+
+	req := &mp.Query{
+		MsgHeader:          &mp.MsgHeader{RequestID: 1, Opcode: mp.OP_QUERY},
+		FullCollectionName: "test.$cmd",
+		Query:              bson.D{{Name: "dropDatabase", Value: 1}},
+	}
+
+	_, reply, e := deny(context.Background(), req)
+	if e != nil {
+		t.Fatalf("Intercept: %v", e)
+	}
+	if reply == nil {
+		t.Fatal("denied command was not short-circuited")
+	}
+
+	asReply, ok := reply.(*mp.Reply)
+	if !ok {
+		t.Fatalf("reply = %T, want *mp.Reply for a legacy Query request", reply)
+	}
+	if len(asReply.Documents) != 1 || truthy(asReply.Documents[0], "ok") {
+		t.Errorf("Documents = %v, want ok: 0", asReply.Documents)
+	}
+}
+
+func TestDenyListPassesThroughOthers(t *testing.T) {
+	deny := DenyList("dropDatabase")
+
+	req := &mp.Query{
+		MsgHeader:          &mp.MsgHeader{RequestID: 1, Opcode: mp.OP_QUERY},
+		FullCollectionName: "test.$cmd",
+		Query:              bson.D{{Name: "ping", Value: 1}},
+	}
+
+	_, reply, e := deny(context.Background(), req)
+	if e != nil || reply != nil {
+		t.Fatalf("Intercept() = %v, %v, want pass-through", reply, e)
+	}
+}
+
+// TestDenyListRepliesAsOpMsg is a regression test: a deny-listed command
+// sent over OP_MSG (as every current driver does) must get its
+// short-circuit error back as an OpMsg too, not a legacy OP_REPLY the
+// driver won't recognize as a response to its request.
+func TestDenyListRepliesAsOpMsg(t *testing.T) {
+	deny := DenyList("dropDatabase")
+
+	req := &mp.OpMsg{
+		MsgHeader: &mp.MsgHeader{RequestID: 1, Opcode: mp.OP_MSG_2013},
+		Sections: []mp.Section{
+			mp.BodySection{Document: bson.D{{Name: "dropDatabase", Value: 1}, {Name: "$db", Value: "test"}}},
+		},
+	}
+
+	_, reply, e := deny(context.Background(), req)
+	if e != nil {
+		t.Fatalf("Intercept: %v", e)
+	}
+
+	if _, ok := reply.(*mp.OpMsg); !ok {
+		t.Fatalf("reply = %T, want *mp.OpMsg for an OpMsg request", reply)
+	}
+}
+
+// TestRouterAcceptsOpMsgReply is a regression test for Router.Intercept
+// only accepting a legacy *mp.Reply back from the remote it dials: a
+// 3.6+ server replies to an OpMsg request with an OpMsg of its own, and
+// that must be passed back rather than rejected as ErrorOpcodeUnknown.
+func TestRouterAcceptsOpMsgReply(t *testing.T) {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatalf("Listen: %v", e)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, e := ln.Accept()
+		if e != nil {
+			return
+		}
+		defer conn.Close()
+
+		req, e := mp.ReadRequest(conn)
+		if e != nil {
+			return
+		}
+
+		reply := &mp.OpMsg{
+			MsgHeader: &mp.MsgHeader{RequestID: 99, ResponseTo: req.GetHeader().RequestID, Opcode: mp.OP_MSG_2013},
+			Sections: []mp.Section{
+				mp.BodySection{Document: bson.D{{Name: "ok", Value: float64(1)}}},
+			},
+		}
+		mp.WriteRequest(reply, conn)
+	}()
+
+	r := &Router{Rules: []RouteRule{{Pattern: "analytics.*", Remote: ln.Addr().String()}}}
+
+	req := &mp.OpMsg{
+		MsgHeader: &mp.MsgHeader{RequestID: 1, Opcode: mp.OP_MSG_2013},
+		Sections: []mp.Section{
+			mp.BodySection{Document: bson.D{{Name: "find", Value: "coll"}, {Name: "$db", Value: "analytics"}}},
+		},
+	}
+
+	done := make(chan struct{})
+	var reply mp.RequestMsg
+	var intErr error
+	go func() {
+		_, reply, intErr = r.Intercept(context.Background(), req)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Intercept did not return in time")
+	}
+
+	if intErr != nil {
+		t.Fatalf("Intercept: %v", intErr)
+	}
+	if _, ok := reply.(*mp.OpMsg); !ok {
+		t.Fatalf("reply = %T, want *mp.OpMsg", reply)
+	}
+}
+
+func truthy(doc bson.D, key string) bool {
+	for _, e := range doc {
+		if e.Name != key {
+			continue
+		}
+		switch v := e.Value.(type) {
+		case float64:
+			return v != 0
+		case int32:
+			return v != 0
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package interceptor
+
+import (
+	"context"
+
+	mp "github.com/julianshen/mongoproxy"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Rewrite is an Interceptor that injects ReadPreference (as
+// $readPreference) and/or MaxTimeMS (as maxTimeMS) into every outgoing
+// Query or OpMsg command that doesn't already set them.
+type Rewrite struct {
+	ReadPreference bson.D
+	MaxTimeMS      int32
+}
+
+func (r Rewrite) Intercept(ctx context.Context, req mp.RequestMsg) (mp.RequestMsg, mp.RequestMsg, error) {
+	switch t := req.(type) {
+	case *mp.Query:
+		t.Query = r.apply(t.Query)
+	case *mp.OpMsg:
+		for i, s := range t.Sections {
+			body, ok := s.(mp.BodySection)
+			if !ok {
+				continue
+			}
+
+			body.Document = r.apply(body.Document)
+			t.Sections[i] = body
+		}
+	}
+
+	return req, nil, nil
+}
+
+func (r Rewrite) apply(doc bson.D) bson.D {
+	if r.MaxTimeMS != 0 && !hasKey(doc, "maxTimeMS") {
+		doc = append(doc, bson.DocElem{Name: "maxTimeMS", Value: r.MaxTimeMS})
+	}
+
+	if len(r.ReadPreference) > 0 && !hasKey(doc, "$readPreference") {
+		doc = append(doc, bson.DocElem{Name: "$readPreference", Value: r.ReadPreference})
+	}
+
+	return doc
+}
+
+func hasKey(doc bson.D, key string) bool {
+	for _, e := range doc {
+		if e.Name == key {
+			return true
+		}
+	}
+	return false
+}
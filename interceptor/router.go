@@ -0,0 +1,155 @@
+package interceptor
+
+import (
+	"context"
+	"net"
+	"os"
+	"path"
+	"sync"
+
+	mp "github.com/julianshen/mongoproxy"
+	"gopkg.in/yaml.v2"
+)
+
+// RouteRule sends requests whose namespace matches Pattern (a path.Match
+// glob over "db.collection", e.g. "analytics.*") to Remote instead of the
+// proxy's configured upstream.
+type RouteRule struct {
+	Pattern string `yaml:"pattern"`
+	Remote  string `yaml:"remote"`
+}
+
+type routerConfig struct {
+	Rules []RouteRule `yaml:"rules"`
+}
+
+// Router is an Interceptor that dispatches requests matching one of
+// Rules to that rule's Remote, bypassing the proxy's own upstream
+// entirely: it dials Remote itself and returns the reply as a
+// short-circuit. Requests matching no rule pass through unchanged.
+//
+// Intercept runs concurrently, once per client connection, so each
+// Remote's connection is guarded by its own lock held across the whole
+// write/read round trip -- without it, two client connections routed to
+// the same Remote could interleave writes mid-message, or one could read
+// back the other's reply.
+type Router struct {
+	Rules []RouteRule
+
+	mu    sync.Mutex
+	conns map[string]net.Conn
+	locks map[string]*sync.Mutex
+}
+
+// LoadRouter reads a routing rules file shaped like:
+//
+//	rules:
+//	  - pattern: "analytics.*"
+//	    remote: "analytics-replica:27017"
+func LoadRouter(path string) (*Router, error) {
+	b, e := os.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+
+	var cfg routerConfig
+	if e := yaml.Unmarshal(b, &cfg); e != nil {
+		return nil, e
+	}
+
+	return &Router{Rules: cfg.Rules}, nil
+}
+
+func (r *Router) Intercept(ctx context.Context, req mp.RequestMsg) (mp.RequestMsg, mp.RequestMsg, error) {
+	ns, _ := mp.Namespace(req)
+
+	remote := ""
+	for _, rule := range r.Rules {
+		if ok, _ := path.Match(rule.Pattern, ns); ok {
+			remote = rule.Remote
+			break
+		}
+	}
+
+	if remote == "" {
+		return req, nil, nil
+	}
+
+	lock := r.lockFor(remote)
+	lock.Lock()
+	defer lock.Unlock()
+
+	c, e := r.conn(remote)
+	if e != nil {
+		return nil, nil, e
+	}
+
+	if e := mp.WriteRequest(req, c); e != nil {
+		r.drop(remote)
+		return nil, nil, e
+	}
+
+	reply, e := mp.ReadRequest(c)
+	if e != nil {
+		r.drop(remote)
+		return nil, nil, e
+	}
+
+	// A 3.6+ remote replies to an OpMsg request with an OpMsg of its own
+	// (opcode 2013), not the legacy Reply (opcode 1) -- this needs to
+	// accept either shape, not just the latter, or it would tear down
+	// the client connection on essentially every routed query.
+	switch reply.(type) {
+	case *mp.Reply, *mp.OpMsg, *mp.Compressed:
+		return req, reply, nil
+	default:
+		return nil, nil, mp.ErrorOpcodeUnknown
+	}
+}
+
+func (r *Router) lockFor(remote string) *sync.Mutex {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.locks == nil {
+		r.locks = make(map[string]*sync.Mutex)
+	}
+
+	l, ok := r.locks[remote]
+	if !ok {
+		l = &sync.Mutex{}
+		r.locks[remote] = l
+	}
+	return l
+}
+
+func (r *Router) conn(remote string) (net.Conn, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.conns == nil {
+		r.conns = make(map[string]net.Conn)
+	}
+
+	if c, ok := r.conns[remote]; ok {
+		return c, nil
+	}
+
+	c, e := net.Dial("tcp", remote)
+	if e != nil {
+		return nil, e
+	}
+
+	r.conns[remote] = c
+	return c, nil
+}
+
+func (r *Router) drop(remote string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c, ok := r.conns[remote]; ok {
+		c.Close()
+		delete(r.conns, remote)
+	}
+}
@@ -0,0 +1,57 @@
+// Package metrics exposes Prometheus counters/histograms for the ops the
+// proxy forwards, served over HTTP by Serve.
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	opsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "mongoproxy_ops_total",
+		Help: "Total number of ops proxied, by op and collection.",
+	}, []string{"op", "collection"})
+
+	opLatencySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "mongoproxy_op_latency_seconds",
+		Help: "End-to-end latency of proxied ops, by op.",
+	}, []string{"op"})
+
+	inflight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "mongoproxy_inflight",
+		Help: "Ops currently dispatched upstream and awaiting a reply.",
+	})
+)
+
+// RecordOp increments the ops counter and observes the total latency for
+// one completed op. ns is the op's "db.collection" namespace, if known.
+func RecordOp(op string, ns string, latency time.Duration) {
+	opsTotal.WithLabelValues(op, collectionOf(ns)).Inc()
+	opLatencySeconds.WithLabelValues(op).Observe(latency.Seconds())
+}
+
+// InflightInc and InflightDec track ops currently dispatched upstream and
+// awaiting a reply.
+func InflightInc() { inflight.Inc() }
+func InflightDec() { inflight.Dec() }
+
+func collectionOf(ns string) string {
+	if i := strings.IndexByte(ns, '.'); i >= 0 {
+		return ns[i+1:]
+	}
+	return ns
+}
+
+// Serve starts an HTTP server exposing the registered metrics at
+// /metrics on addr. It blocks, so run it in its own goroutine.
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollectionOf(t *testing.T) {
+	cases := []struct {
+		ns   string
+		want string
+	}{
+		{"test.coll", "coll"},
+		{"test.nested.coll", "nested.coll"},
+		{"admin", "admin"},
+		{"", ""},
+	}
+
+	for _, c := range cases {
+		if got := collectionOf(c.ns); got != c.want {
+			t.Errorf("collectionOf(%q) = %q, want %q", c.ns, got, c.want)
+		}
+	}
+}
+
+func TestRecordOpIncrementsCounter(t *testing.T) {
+	before := testutil.ToFloat64(opsTotal.WithLabelValues("OP_QUERY", "coll"))
+
+	RecordOp("OP_QUERY", "test.coll", time.Millisecond)
+
+	after := testutil.ToFloat64(opsTotal.WithLabelValues("OP_QUERY", "coll"))
+	if after != before+1 {
+		t.Errorf("opsTotal = %v, want %v", after, before+1)
+	}
+}
+
+func TestInflightIncDec(t *testing.T) {
+	before := testutil.ToFloat64(inflight)
+
+	InflightInc()
+	if got := testutil.ToFloat64(inflight); got != before+1 {
+		t.Errorf("inflight after Inc = %v, want %v", got, before+1)
+	}
+
+	InflightDec()
+	if got := testutil.ToFloat64(inflight); got != before {
+		t.Errorf("inflight after Dec = %v, want %v", got, before)
+	}
+}
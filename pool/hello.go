@@ -0,0 +1,78 @@
+package pool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const opMsg2013 = int32(2013)
+
+var errUnexpectedSection = errors.New("pool: unexpected OP_MSG section kind in hello reply")
+
+// probeHello sends a bare "hello" command over conn and returns the
+// decoded reply document. It speaks just enough hand-rolled OP_MSG to
+// avoid depending on the core wire package, which would import pool back
+// (Proxy embeds a *Pool) and create a cycle.
+func probeHello(conn net.Conn) (bson.D, error) {
+	body, e := bson.Marshal(bson.D{{Name: "hello", Value: 1}, {Name: "$db", Value: "admin"}})
+	if e != nil {
+		return nil, e
+	}
+
+	w := bufio.NewWriter(conn)
+	header := [4]int32{int32(16 + 4 + 1 + len(body)), 1, 0, opMsg2013}
+	for _, v := range header {
+		if e := binary.Write(w, binary.LittleEndian, v); e != nil {
+			return nil, e
+		}
+	}
+	if e := binary.Write(w, binary.LittleEndian, int32(0)); e != nil { // flagBits
+		return nil, e
+	}
+	if e := w.WriteByte(0); e != nil { // section kind 0: body
+		return nil, e
+	}
+	if _, e := w.Write(body); e != nil {
+		return nil, e
+	}
+	if e := w.Flush(); e != nil {
+		return nil, e
+	}
+
+	r := bufio.NewReader(conn)
+	var messageLength, requestID, responseTo, opcode int32
+	for _, p := range []*int32{&messageLength, &requestID, &responseTo, &opcode} {
+		if e := binary.Read(r, binary.LittleEndian, p); e != nil {
+			return nil, e
+		}
+	}
+
+	var flagBits int32
+	if e := binary.Read(r, binary.LittleEndian, &flagBits); e != nil {
+		return nil, e
+	}
+
+	kind, e := r.ReadByte()
+	if e != nil {
+		return nil, e
+	}
+	if kind != 0 {
+		return nil, errUnexpectedSection
+	}
+
+	raw := make([]byte, int(messageLength)-16-4-1)
+	if _, e := io.ReadFull(r, raw); e != nil {
+		return nil, e
+	}
+
+	var doc bson.D
+	if e := bson.Unmarshal(raw, &doc); e != nil {
+		return nil, e
+	}
+	return doc, nil
+}
@@ -0,0 +1,154 @@
+// Package pool gives Proxy a checkout-based connection pool to a set of
+// upstream addresses, plus the topology monitoring and routing needed to
+// spread and pin traffic across a replica set.
+package pool
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Dialer dials a fresh, ready-to-use connection to addr -- TLS and
+// upstream authentication, if any, are the caller's concern to bake into
+// this closure, since Pool itself only manages idle/in-use bookkeeping.
+type Dialer func(addr string) (net.Conn, error)
+
+type pooledConn struct {
+	conn     net.Conn
+	lastUsed time.Time
+}
+
+// Pool is a per-address pool of upstream connections, checked out for the
+// duration of one proxied request and returned (or discarded, if it
+// turned out broken) afterward.
+type Pool struct {
+	Dial        Dialer
+	MinSize     int // recorded from New; no Pool method reads it
+	MaxSize     int // cap on connections concurrently checked out per address; <= 0 means unbounded
+	IdleTimeout time.Duration
+
+	mu    sync.Mutex
+	idle  map[string][]*pooledConn
+	inUse map[string]int
+	sema  map[string]chan struct{}
+}
+
+// New builds a Pool. MinSize is stored but not consulted: Release closes a
+// returned connection only when the idle bucket already holds MaxSize,
+// Checkout closes expired idle connections however few remain, and the
+// pool never pre-dials, since it only learns addresses lazily from
+// Checkout.
+func New(dial Dialer, minSize, maxSize int, idleTimeout time.Duration) *Pool {
+	return &Pool{
+		Dial:        dial,
+		MinSize:     minSize,
+		MaxSize:     maxSize,
+		IdleTimeout: idleTimeout,
+		idle:        make(map[string][]*pooledConn),
+		inUse:       make(map[string]int),
+	}
+}
+
+// Checkout returns an idle, non-expired connection to addr if one is
+// available, else dials a fresh one via Dial. When MaxSize > 0, it blocks
+// until fewer than MaxSize connections to addr are checked out, so the
+// pool is an actual bound on concurrent upstream load rather than just a
+// cap on how many idle connections accumulate.
+func (p *Pool) Checkout(addr string) (net.Conn, error) {
+	p.acquire(addr)
+
+	p.mu.Lock()
+	bucket := p.idle[addr]
+	for len(bucket) > 0 {
+		pc := bucket[len(bucket)-1]
+		bucket = bucket[:len(bucket)-1]
+		p.idle[addr] = bucket
+
+		if p.IdleTimeout > 0 && time.Since(pc.lastUsed) > p.IdleTimeout {
+			pc.conn.Close()
+			continue
+		}
+
+		p.inUse[addr]++
+		p.mu.Unlock()
+		return pc.conn, nil
+	}
+	p.mu.Unlock()
+
+	conn, e := p.Dial(addr)
+	if e != nil {
+		p.release(addr)
+		return nil, e
+	}
+
+	p.mu.Lock()
+	p.inUse[addr]++
+	p.mu.Unlock()
+	return conn, nil
+}
+
+// Release returns a healthy conn checked out for addr back to the idle
+// pool, closing it instead if that would push the idle bucket past
+// MaxSize.
+func (p *Pool) Release(addr string, conn net.Conn) {
+	p.mu.Lock()
+	p.inUse[addr]--
+
+	if p.MaxSize > 0 && len(p.idle[addr]) >= p.MaxSize {
+		p.mu.Unlock()
+		conn.Close()
+		p.release(addr)
+		return
+	}
+
+	p.idle[addr] = append(p.idle[addr], &pooledConn{conn: conn, lastUsed: time.Now()})
+	p.mu.Unlock()
+
+	p.release(addr)
+}
+
+// Discard closes a conn checked out for addr instead of returning it to
+// the pool, for when a request on it failed and it can't be trusted.
+func (p *Pool) Discard(addr string, conn net.Conn) {
+	conn.Close()
+
+	p.mu.Lock()
+	p.inUse[addr]--
+	p.mu.Unlock()
+
+	p.release(addr)
+}
+
+// acquire blocks, when MaxSize > 0, until fewer than MaxSize connections
+// to addr are checked out.
+func (p *Pool) acquire(addr string) {
+	if p.MaxSize <= 0 {
+		return
+	}
+	p.semaphore(addr) <- struct{}{}
+}
+
+// release frees the concurrency slot acquire took for addr.
+func (p *Pool) release(addr string) {
+	if p.MaxSize <= 0 {
+		return
+	}
+	<-p.semaphore(addr)
+}
+
+func (p *Pool) semaphore(addr string) chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.sema == nil {
+		p.sema = make(map[string]chan struct{})
+	}
+
+	ch, ok := p.sema[addr]
+	if !ok {
+		ch = make(chan struct{}, p.MaxSize)
+		p.sema[addr] = ch
+	}
+	return ch
+}
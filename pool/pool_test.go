@@ -0,0 +1,119 @@
+package pool
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeConn is a net.Conn that only tracks whether Close was called;
+// nothing in pool.go reads or writes through the connections it hands
+// out, so the rest of the interface is never exercised.
+type fakeConn struct {
+	net.Conn
+	closed int32
+}
+
+func (c *fakeConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return nil
+}
+
+func (c *fakeConn) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) != 0
+}
+
+func TestCheckoutReusesReleasedConnection(t *testing.T) {
+	var dials int32
+	p := New(func(addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return &fakeConn{}, nil
+	}, 0, 0, 0)
+
+	c1, e := p.Checkout("a:1")
+	if e != nil {
+		t.Fatalf("Checkout: %v", e)
+	}
+	p.Release("a:1", c1)
+
+	c2, e := p.Checkout("a:1")
+	if e != nil {
+		t.Fatalf("Checkout: %v", e)
+	}
+
+	if c1 != c2 {
+		t.Error("Checkout after Release dialed a fresh connection instead of reusing the idle one")
+	}
+	if atomic.LoadInt32(&dials) != 1 {
+		t.Errorf("Dial called %d times, want 1", dials)
+	}
+}
+
+func TestDiscardClosesAndDoesNotReuse(t *testing.T) {
+	var dials int32
+	p := New(func(addr string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return &fakeConn{}, nil
+	}, 0, 0, 0)
+
+	c1, _ := p.Checkout("a:1")
+	p.Discard("a:1", c1)
+
+	if !c1.(*fakeConn).isClosed() {
+		t.Error("Discard did not close the connection")
+	}
+
+	if _, e := p.Checkout("a:1"); e != nil {
+		t.Fatalf("Checkout: %v", e)
+	}
+	if atomic.LoadInt32(&dials) != 2 {
+		t.Errorf("Dial called %d times, want 2 (discarded connection must not be reused)", dials)
+	}
+}
+
+// TestMaxSizeBoundsConcurrentCheckouts is a regression test for the bug
+// where MaxSize only capped the idle bucket: Checkout must block once
+// MaxSize connections to an address are concurrently checked out, not
+// just once MaxSize are sitting idle.
+func TestMaxSizeBoundsConcurrentCheckouts(t *testing.T) {
+	const maxSize = 2
+
+	p := New(func(addr string) (net.Conn, error) {
+		return &fakeConn{}, nil
+	}, 0, maxSize, 0)
+
+	var current, peak int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			c, e := p.Checkout("a:1")
+			if e != nil {
+				t.Errorf("Checkout: %v", e)
+				return
+			}
+
+			n := atomic.AddInt32(&current, 1)
+			for {
+				prev := atomic.LoadInt32(&peak)
+				if n <= prev || atomic.CompareAndSwapInt32(&peak, prev, n) {
+					break
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+
+			atomic.AddInt32(&current, -1)
+			p.Release("a:1", c)
+		}()
+	}
+	wg.Wait()
+
+	if peak > maxSize {
+		t.Errorf("peak concurrent checkouts = %d, want <= %d", peak, maxSize)
+	}
+}
@@ -0,0 +1,92 @@
+package pool
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// ReadPreference picks which class of server Select considers.
+type ReadPreference string
+
+const (
+	Primary          ReadPreference = "primary"
+	PrimaryPreferred ReadPreference = "primaryPreferred"
+	Secondary        ReadPreference = "secondary"
+	Nearest          ReadPreference = "nearest"
+)
+
+// LocalThreshold is the RTT window within which servers are considered
+// equally near, mirroring the official drivers' 15ms default.
+const LocalThreshold = 15 * time.Millisecond
+
+// ErrNoServer is returned by Select when no server matches pref.
+var ErrNoServer = errors.New("pool: no server available for read preference")
+
+// Select picks one address from t's current topology matching pref.
+// Among secondary/nearest candidates within LocalThreshold of the fastest
+// eligible RTT, one is chosen at random so load spreads across them,
+// rather than pinning every read to whichever happens to be fastest.
+func (t *Topology) Select(pref ReadPreference) (string, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var primary *ServerDescription
+	var secondaries []*ServerDescription
+	for _, d := range t.servers {
+		if d.Err != nil {
+			continue
+		}
+		if d.IsPrimary {
+			primary = d
+		} else if d.IsSecondary {
+			secondaries = append(secondaries, d)
+		}
+	}
+
+	switch pref {
+	case Primary:
+		if primary == nil {
+			return "", ErrNoServer
+		}
+		return primary.Address, nil
+	case PrimaryPreferred:
+		if primary != nil {
+			return primary.Address, nil
+		}
+		return nearest(secondaries)
+	case Secondary:
+		return nearest(secondaries)
+	case Nearest:
+		candidates := secondaries
+		if primary != nil {
+			candidates = append(append([]*ServerDescription{}, secondaries...), primary)
+		}
+		return nearest(candidates)
+	default:
+		return "", fmt.Errorf("pool: unknown read preference %q", pref)
+	}
+}
+
+func nearest(candidates []*ServerDescription) (string, error) {
+	if len(candidates) == 0 {
+		return "", ErrNoServer
+	}
+
+	best := candidates[0].RTT
+	for _, d := range candidates[1:] {
+		if d.RTT < best {
+			best = d.RTT
+		}
+	}
+
+	within := make([]*ServerDescription, 0, len(candidates))
+	for _, d := range candidates {
+		if d.RTT <= best+LocalThreshold {
+			within = append(within, d)
+		}
+	}
+
+	return within[rand.Intn(len(within))].Address, nil
+}
@@ -0,0 +1,150 @@
+package pool
+
+import (
+	"sync"
+	"time"
+)
+
+// ServerDescription is what the topology monitor learned about one server
+// from its most recent hello reply.
+type ServerDescription struct {
+	Address     string
+	Hosts       []string
+	SetName     string
+	IsPrimary   bool
+	IsSecondary bool
+	RTT         time.Duration
+	LastUpdated time.Time
+	Err         error // set when the last probe failed; server is excluded from routing
+}
+
+// Topology periodically sends hello to a set of seed addresses, and to
+// any further hosts those replies mention, keeping a ServerDescription
+// per address known so far.
+type Topology struct {
+	Dial         Dialer
+	PollInterval time.Duration
+
+	mu      sync.RWMutex
+	servers map[string]*ServerDescription
+	stop    chan struct{}
+}
+
+// NewTopology builds a Topology seeded with addrs. Call Start to begin
+// polling.
+func NewTopology(dial Dialer, addrs []string, pollInterval time.Duration) *Topology {
+	servers := make(map[string]*ServerDescription, len(addrs))
+	for _, a := range addrs {
+		servers[a] = &ServerDescription{Address: a}
+	}
+
+	return &Topology{
+		Dial:         dial,
+		PollInterval: pollInterval,
+		servers:      servers,
+		stop:         make(chan struct{}),
+	}
+}
+
+// Start polls every known address once immediately, then every
+// PollInterval, until Stop is called. Meant to be run in its own
+// goroutine by the caller.
+func (t *Topology) Start() {
+	t.poll()
+
+	ticker := time.NewTicker(t.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.poll()
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// Stop ends a running Start loop.
+func (t *Topology) Stop() {
+	close(t.stop)
+}
+
+// Servers returns a snapshot of everything currently known.
+func (t *Topology) Servers() map[string]ServerDescription {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	out := make(map[string]ServerDescription, len(t.servers))
+	for addr, d := range t.servers {
+		out[addr] = *d
+	}
+	return out
+}
+
+func (t *Topology) poll() {
+	for _, addr := range t.knownAddresses() {
+		desc := t.probe(addr)
+
+		t.mu.Lock()
+		t.servers[addr] = desc
+		for _, h := range desc.Hosts {
+			if _, ok := t.servers[h]; !ok {
+				t.servers[h] = &ServerDescription{Address: h}
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *Topology) knownAddresses() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	addrs := make([]string, 0, len(t.servers))
+	for addr := range t.servers {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func (t *Topology) probe(addr string) *ServerDescription {
+	start := time.Now()
+
+	conn, e := t.Dial(addr)
+	if e != nil {
+		return &ServerDescription{Address: addr, Err: e, LastUpdated: time.Now()}
+	}
+	defer conn.Close()
+
+	doc, e := probeHello(conn)
+	rtt := time.Since(start)
+	if e != nil {
+		return &ServerDescription{Address: addr, Err: e, RTT: rtt, LastUpdated: time.Now()}
+	}
+
+	m := doc.Map()
+	desc := &ServerDescription{Address: addr, RTT: rtt, LastUpdated: time.Now()}
+
+	if setName, ok := m["setName"].(string); ok {
+		desc.SetName = setName
+	}
+	if isPrimary, ok := m["isWritablePrimary"].(bool); ok {
+		desc.IsPrimary = isPrimary
+	} else if isPrimary, ok := m["ismaster"].(bool); ok {
+		desc.IsPrimary = isPrimary
+	}
+	if isSecondary, ok := m["secondary"].(bool); ok {
+		desc.IsSecondary = isSecondary
+	}
+	if hosts, ok := m["hosts"].([]interface{}); ok {
+		desc.Hosts = make([]string, 0, len(hosts))
+		for _, h := range hosts {
+			if s, ok := h.(string); ok {
+				desc.Hosts = append(desc.Hosts, s)
+			}
+		}
+	}
+
+	return desc
+}
@@ -1,13 +1,34 @@
 package mongoproxy
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net"
 	"time"
+
+	"github.com/julianshen/mongoproxy/metrics"
+	"github.com/julianshen/mongoproxy/pool"
 )
 
+// Interceptor inspects or rewrites a request before it's forwarded
+// upstream. Returning a replacement RequestMsg forwards that instead of
+// the original; returning a non-nil reply short-circuits the upstream
+// entirely and writes that reply back to the client instead (shape it to
+// match req -- e.g. with NewErrorReply -- since a modern driver sending
+// OP_MSG won't accept a legacy OP_REPLY back); returning an error tears
+// the connection down.
+type Interceptor func(ctx context.Context, req RequestMsg) (RequestMsg, RequestMsg, error)
+
+// UpstreamAuthenticator authenticates the single upstream connection each
+// client's requests are proxied over, once per connection and before any
+// client traffic is forwarded. See package auth for a SCRAM implementation.
+type UpstreamAuthenticator interface {
+	Authenticate(conn net.Conn) error
+}
+
 type LogMsg struct {
 	Time     time.Time
 	TimeUsed time.Duration
@@ -28,84 +49,382 @@ func toJSON(v interface{}) string {
 	return string(b)
 }
 
+// Direction indicates which way a message travelled through the proxy.
+type Direction int
+
+const (
+	DirectionRequest Direction = iota
+	DirectionResponse
+)
+
+// Sink receives every message handleConnection parses, in both
+// directions, so logging/recording concerns can be layered in without
+// touching the proxy loop itself.
+type Sink interface {
+	Record(dir Direction, connNum int64, t time.Time, d time.Duration, r RequestMsg)
+}
+
+// ConnectionCloser is implemented by Sinks that need to know when a
+// client connection ends -- e.g. recorder.CaptureSink, which writes a
+// terminal EOF frame so Replay knows where one connection's traffic
+// stops and the next begins.
+type ConnectionCloser interface {
+	CloseConnection(connNum int64, t time.Time)
+}
+
+// JSONLogSink is the default Sink: it prints each message as indented
+// JSON, the proxy's original logging behavior. Responses are only printed
+// when LogResponse is set.
+type JSONLogSink struct {
+	LogResponse bool
+}
+
+func (s *JSONLogSink) Record(dir Direction, connNum int64, t time.Time, d time.Duration, r RequestMsg) {
+	if dir == DirectionResponse && !s.LogResponse {
+		return
+	}
+
+	fmt.Println(toJSON(newLogMsg(t, d, r)))
+}
+
+// FanOutSink forwards every Record call to each of Sinks, so e.g. a
+// JSONLogSink and a BSON capture sink can both observe the same traffic.
+type FanOutSink struct {
+	Sinks []Sink
+}
+
+func (s *FanOutSink) Record(dir Direction, connNum int64, t time.Time, d time.Duration, r RequestMsg) {
+	for _, sink := range s.Sinks {
+		sink.Record(dir, connNum, t, d, r)
+	}
+}
+
+// CloseConnection forwards to every Sink that implements ConnectionCloser.
+func (s *FanOutSink) CloseConnection(connNum int64, t time.Time) {
+	for _, sink := range s.Sinks {
+		if closer, ok := sink.(ConnectionCloser); ok {
+			closer.CloseConnection(connNum, t)
+		}
+	}
+}
+
+// EventSink is implemented by Sinks that want the structured per-op
+// OpEvent handleConnection builds after each proxied request completes --
+// e.g. JSONLogSink, which prints it. Sinks that don't care about it (e.g.
+// recorder.CaptureSink, which only records wire frames) simply don't
+// implement it, the same optional-interface pattern as ConnectionCloser.
+type EventSink interface {
+	RecordEvent(e OpEvent)
+}
+
+// RecordEvent prints e as indented JSON, alongside the per-message output
+// of Record.
+func (s *JSONLogSink) RecordEvent(e OpEvent) {
+	fmt.Println(toJSON(e))
+}
+
+// RecordEvent forwards to every Sink that implements EventSink.
+func (s *FanOutSink) RecordEvent(e OpEvent) {
+	for _, sink := range s.Sinks {
+		if es, ok := sink.(EventSink); ok {
+			es.RecordEvent(e)
+		}
+	}
+}
+
+// newLogMsg builds the LogMsg for a parsed op. OP_COMPRESSED is unwrapped
+// so the log shows both the outer compression metadata and the inner
+// decoded op, rather than just an opaque byte blob.
+func newLogMsg(t time.Time, d time.Duration, r RequestMsg) LogMsg {
+	if c, ok := r.(*Compressed); ok {
+		content := struct {
+			Compression CompressorID
+			Inner       RequestMsg
+		}{Compression: c.CompressorID, Inner: c.Inner}
+
+		return LogMsg{Time: t, TimeUsed: d, Type: c.GetOp().String(), Content: &content}
+	}
+
+	return LogMsg{Time: t, TimeUsed: d, Type: r.GetOp().String(), Content: &r}
+}
+
 type Proxy struct {
-	Remote  string
-	Port    int
-	LogResp bool
+	Remote       string
+	Port         int
+	LogResp      bool
+	Sink         Sink
+	Interceptors []Interceptor
+
+	// TLSConfig, if set, makes Start accept TLS connections from clients
+	// instead of plain TCP (set Certificates, and ClientCAs/ClientAuth for
+	// mutual TLS).
+	TLSConfig *tls.Config
+
+	// UpstreamTLSConfig, if set, makes handleConnection initiate TLS to
+	// Remote instead of plain TCP (set RootCAs/ServerName as needed).
+	UpstreamTLSConfig *tls.Config
+
+	// UpstreamAuth, if set, authenticates each upstream connection right
+	// after it's dialed, before any client traffic is forwarded over it.
+	// Ignored when Pool is set -- bake authentication into Pool.Dial
+	// instead, since the pool's connections outlive any one client.
+	UpstreamAuth UpstreamAuthenticator
+
+	// Pool and Topology, if both set, replace the single dial-and-hold
+	// connection to Remote with a per-request checkout routed across the
+	// replica set Topology discovers, via ReadPreference. Remote,
+	// UpstreamTLSConfig and UpstreamAuth above are then unused.
+	Pool           *pool.Pool
+	Topology       *pool.Topology
+	ReadPreference pool.ReadPreference
+}
+
+// writeCommands are command names that must always go to the primary,
+// regardless of ReadPreference -- both the fixed names Namespace reports
+// for legacy opcodes and the command names of an OpMsg whose first key
+// names a write.
+var writeCommands = map[string]bool{
+	"insert": true, "update": true, "delete": true,
+	"findAndModify": true, "findandmodify": true,
+	"create": true, "drop": true, "dropDatabase": true,
+	"createIndexes": true, "dropIndexes": true, "renameCollection": true,
+}
+
+// selectServer picks which upstream address req should be dispatched to
+// when p.Pool/p.Topology are in use: get-mores and kill-cursors are
+// pinned back to whichever server returned the cursor, writes always go
+// to the primary, and everything else follows p.ReadPreference.
+func (p *Proxy) selectServer(req RequestMsg, command string, cursors *cursorTracker) (string, error) {
+	switch t := req.(type) {
+	case *GetMore:
+		if _, server := cursors.lookup(t.CursorID); server != "" {
+			return server, nil
+		}
+	case *KillCursors:
+		for _, id := range t.CursorIDs {
+			if _, server := cursors.lookup(id); server != "" {
+				return server, nil
+			}
+		}
+	}
+
+	switch req.(type) {
+	case *Insert, *Update, *Delete:
+		return p.Topology.Select(pool.Primary)
+	}
+
+	if writeCommands[command] {
+		return p.Topology.Select(pool.Primary)
+	}
+
+	pref := p.ReadPreference
+	if pref == "" {
+		pref = pool.Primary
+	}
+	return p.Topology.Select(pref)
 }
 
 func (p *Proxy) Start() error {
 	port := fmt.Sprintf(":%d", p.Port)
-	listener, err := net.Listen("tcp", port)
+
+	var listener net.Listener
+	var err error
+	if p.TLSConfig != nil {
+		listener, err = tls.Listen("tcp", port, p.TLSConfig)
+	} else {
+		listener, err = net.Listen("tcp", port)
+	}
 
 	if err != nil {
 		return err
 	}
 
+	if p.Sink == nil {
+		p.Sink = &JSONLogSink{LogResponse: p.LogResp}
+	}
+
+	var connNum int64
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
 			return err
 		}
-		go p.handleConnection(conn)
+		connNum++
+		go p.handleConnection(conn, connNum)
 	}
 }
 
-func (p *Proxy) handleConnection(conn net.Conn) {
-	c, e := net.Dial("tcp", p.Remote)
-	defer c.Close()
+// intercept runs req through p.Interceptors in order, updating *req with
+// any replacement each one returns. It stops and returns the first
+// non-nil reply or error.
+func (p *Proxy) intercept(req *RequestMsg) (RequestMsg, error) {
+	ctx := context.Background()
+
+	for _, ic := range p.Interceptors {
+		replacement, reply, e := ic(ctx, *req)
+		if e != nil {
+			return nil, e
+		}
+
+		*req = replacement
+
+		if reply != nil {
+			return reply, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (p *Proxy) handleConnection(conn net.Conn, connNum int64) {
 	defer conn.Close()
+	defer func() {
+		if closer, ok := p.Sink.(ConnectionCloser); ok {
+			closer.CloseConnection(connNum, time.Now())
+		}
+	}()
 
-	if e != nil {
-		t := time.Now()
-		l := LogMsg{Time: t, TimeUsed: 0, Type: "ERROR", Content: e}
-		fmt.Println(toJSON(l))
-		return
+	pooled := p.Pool != nil && p.Topology != nil
+
+	// c is the single upstream connection held for conn's lifetime when
+	// not pooled; unused (nil) in pooled mode, where each request checks
+	// out its own connection from p.Pool instead.
+	var c net.Conn
+	if !pooled {
+		var e error
+		if p.UpstreamTLSConfig != nil {
+			c, e = tls.Dial("tcp", p.Remote, p.UpstreamTLSConfig)
+		} else {
+			c, e = net.Dial("tcp", p.Remote)
+		}
+
+		if e != nil {
+			l := LogMsg{Time: time.Now(), TimeUsed: 0, Type: "ERROR", Content: e}
+			fmt.Println(toJSON(l))
+			return
+		}
+		defer c.Close()
+
+		if p.UpstreamAuth != nil {
+			if e := p.UpstreamAuth.Authenticate(c); e != nil {
+				l := LogMsg{Time: time.Now(), TimeUsed: 0, Type: "ERROR", Content: e}
+				fmt.Println(toJSON(l))
+				return
+			}
+		}
 	}
 
+	cursors := newCursorTracker()
+
 	for {
-		var r RequestMsg
+		var req RequestMsg
 		var e error
 
 		t := time.Now()
-		d := timed(func() {
-			r, e = ReadRequest(conn)
+		durationParse := timed(func() {
+			req, e = ReadRequest(conn)
 		})
 
 		if e != nil {
 			if e != io.EOF {
-				l := LogMsg{Time: t, TimeUsed: d, Type: "ERROR", Content: e}
+				l := LogMsg{Time: t, TimeUsed: durationParse, Type: "ERROR", Content: e}
 				fmt.Println(toJSON(l))
 			}
 			break
 		}
 
-		l := LogMsg{Time: t, TimeUsed: d, Type: r.GetOp().String(), Content: &r}
+		p.Sink.Record(DirectionRequest, connNum, t, durationParse, req)
+
+		shortCircuit, e := p.intercept(&req)
+		if e != nil {
+			l := LogMsg{Time: t, TimeUsed: 0, Type: "ERROR", Content: e}
+			fmt.Println(toJSON(l))
+			break
+		}
+		if shortCircuit != nil {
+			WriteRequest(shortCircuit, conn)
+			continue
+		}
+
+		ns, command := Namespace(req)
+		if ns == "" {
+			if kc, ok := req.(*KillCursors); ok {
+				for _, id := range kc.CursorIDs {
+					if found, _ := cursors.lookup(id); found != "" {
+						ns = found
+						break
+					}
+				}
+			}
+		}
 
-		fmt.Println(toJSON(l))
+		upstream := c
+		server := p.Remote
+		if pooled {
+			var selectErr error
+			server, selectErr = p.selectServer(req, command, cursors)
+			if selectErr != nil {
+				l := LogMsg{Time: t, TimeUsed: 0, Type: "ERROR", Content: selectErr}
+				fmt.Println(toJSON(l))
+				break
+			}
+
+			upstream, e = p.Pool.Checkout(server)
+			if e != nil {
+				l := LogMsg{Time: t, TimeUsed: 0, Type: "ERROR", Content: e}
+				fmt.Println(toJSON(l))
+				break
+			}
+		}
 
-		d = timed(func() {
-			e = WriteRequest(r, c)
+		metrics.InflightInc()
+		var reply RequestMsg
+		durationUpstream := timed(func() {
+			e = WriteRequest(req, upstream)
 
 			if e != nil {
 				return
 			}
 
-			r, e = ReadRequest(c) //Read reply
+			reply, e = ReadRequest(upstream) //Read reply
 		})
+		metrics.InflightDec()
 
 		if e != nil {
+			if pooled {
+				p.Pool.Discard(server, upstream)
+			}
 			if e != io.EOF {
-				l := LogMsg{Time: t, TimeUsed: d, Type: "ERROR", Content: e}
+				l := LogMsg{Time: t, TimeUsed: durationUpstream, Type: "ERROR", Content: e}
 				fmt.Println(toJSON(l))
 			}
 			break
-		} else {
-			if p.LogResp {
-				l := LogMsg{Time: t, TimeUsed: d, Type: r.GetOp().String(), Content: &r}
-				fmt.Println(toJSON(l))
-			}
-			WriteRequest(r, conn)
+		}
+
+		if pooled {
+			p.Pool.Release(server, upstream)
+		}
+
+		p.Sink.Record(DirectionResponse, connNum, t, durationUpstream, reply)
+		WriteRequest(reply, conn)
+
+		summary := replySummary(reply)
+		cursors.observe(req, ns, server, summary)
+
+		durationTotal := durationParse + durationUpstream
+		metrics.RecordOp(req.GetOp().String(), ns, durationTotal)
+
+		if es, ok := p.Sink.(EventSink); ok {
+			es.RecordEvent(OpEvent{
+				RequestID:        req.GetHeader().RequestID,
+				Op:               req.GetOp().String(),
+				NS:               ns,
+				Command:          command,
+				DurationParse:    durationParse,
+				DurationUpstream: durationUpstream,
+				DurationTotal:    durationTotal,
+				Reply:            summary,
+			})
 		}
 	}
 }
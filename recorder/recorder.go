@@ -0,0 +1,226 @@
+// Package recorder captures proxied mongoproxy traffic to a replayable
+// BSON file compatible with mongoreplay's capture format, and replays it
+// back against a target MongoDB.
+package recorder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	mp "github.com/julianshen/mongoproxy"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Frame is one recorded message in the capture file. The file is a
+// stream of int32-length-prefixed BSON documents, one per Frame, so it
+// can be read back without an index.
+type Frame struct {
+	Order         int64  `bson:"order"`
+	Seen          int64  `bson:"seen"` // microseconds since epoch
+	ConnectionNum int64  `bson:"connection_num"`
+	EOF           bool   `bson:"eof"`
+	PlaybackTime  int64  `bson:"playbackTime"` // microseconds since the first recorded frame
+	OpCode        int32  `bson:"opCode"`
+	MsgHeader     []byte `bson:"msgHeader"`
+	Body          []byte `bson:"body"` // raw wire bytes, excluding msgHeader
+}
+
+// CaptureSink is a mongoproxy.Sink that appends a Frame for every client
+// request it's given, for later use with Replayer; upstream replies passed
+// to Record are not written. The zero value is not usable;
+// construct one with NewCaptureSink.
+type CaptureSink struct {
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	order   int64
+	started time.Time
+}
+
+// NewCaptureSink creates path and returns a CaptureSink writing to it.
+// Close must be called when done to flush and release the file.
+func NewCaptureSink(path string) (*CaptureSink, error) {
+	f, e := os.Create(path)
+	if e != nil {
+		return nil, e
+	}
+
+	return &CaptureSink{f: f, w: bufio.NewWriter(f), started: time.Now()}, nil
+}
+
+func (s *CaptureSink) Record(dir mp.Direction, connNum int64, t time.Time, d time.Duration, r mp.RequestMsg) {
+	if dir != mp.DirectionRequest {
+		// Replay only ever re-sends what the client sent; capturing
+		// upstream replies too would make Replay write them back out as
+		// if they were further requests.
+		return
+	}
+
+	var wire bytes.Buffer
+	if e := mp.WriteRequest(r, &wire); e != nil {
+		return
+	}
+	raw := wire.Bytes()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	frame := Frame{
+		Order:         s.order,
+		Seen:          t.UnixNano() / int64(time.Microsecond),
+		ConnectionNum: connNum,
+		EOF:           false,
+		PlaybackTime:  t.Sub(s.started).Microseconds(),
+		OpCode:        int32(r.GetOp()),
+		MsgHeader:     raw[:mp.HEADER_SIZE],
+		Body:          raw[mp.HEADER_SIZE:],
+	}
+	s.order++
+
+	b, e := bson.Marshal(frame)
+	if e != nil {
+		return
+	}
+
+	binary.Write(s.w, binary.LittleEndian, int32(len(b)))
+	s.w.Write(b)
+	s.w.Flush()
+}
+
+// CloseConnection writes a terminal EOF frame for connNum. Replay uses it
+// to close out that connection's socket instead of holding it open (or,
+// if ConnectionNum were ever reused, mistaking the reuse for continued
+// traffic on the same connection). mongoproxy.Proxy calls this via the
+// mp.ConnectionCloser interface when a client connection ends.
+func (s *CaptureSink) CloseConnection(connNum int64, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	frame := Frame{
+		Order:         s.order,
+		Seen:          t.UnixNano() / int64(time.Microsecond),
+		ConnectionNum: connNum,
+		EOF:           true,
+		PlaybackTime:  t.Sub(s.started).Microseconds(),
+	}
+	s.order++
+
+	b, e := bson.Marshal(frame)
+	if e != nil {
+		return
+	}
+
+	binary.Write(s.w, binary.LittleEndian, int32(len(b)))
+	s.w.Write(b)
+	s.w.Flush()
+}
+
+// Close flushes and closes the underlying capture file.
+func (s *CaptureSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.w.Flush()
+	return s.f.Close()
+}
+
+func readFrame(r io.Reader) (*Frame, error) {
+	var ln int32
+	if e := binary.Read(r, binary.LittleEndian, &ln); e != nil {
+		return nil, e
+	}
+
+	b := make([]byte, ln)
+	if _, e := io.ReadFull(r, b); e != nil {
+		return nil, e
+	}
+
+	var frame Frame
+	if e := bson.Unmarshal(b, &frame); e != nil {
+		return nil, e
+	}
+
+	return &frame, nil
+}
+
+// Replayer reads a capture file written by CaptureSink and replays it
+// against Target, preserving each connection's relative timing scaled by
+// Speed (1.0 = real time, 2.0 = twice as fast, 0 defaults to 1.0).
+type Replayer struct {
+	Target string
+	Speed  float64
+}
+
+// Replay reads path and writes each recorded message to its originating
+// connection (grouped by ConnectionNum) against Target, maintaining
+// per-connection ordering and, up to Speed, the original relative timing.
+func (p *Replayer) Replay(path string) error {
+	f, e := os.Open(path)
+	if e != nil {
+		return e
+	}
+	defer f.Close()
+
+	speed := p.Speed
+	if speed <= 0 {
+		speed = 1
+	}
+
+	r := bufio.NewReader(f)
+	conns := make(map[int64]net.Conn)
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	var start time.Time
+	for {
+		frame, e := readFrame(r)
+		if e == io.EOF {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+
+		if start.IsZero() {
+			start = time.Now()
+		}
+
+		target := start.Add(time.Duration(float64(frame.PlaybackTime) * float64(time.Microsecond) / speed))
+		if wait := time.Until(target); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		if frame.EOF {
+			if c, ok := conns[frame.ConnectionNum]; ok {
+				c.Close()
+				delete(conns, frame.ConnectionNum)
+			}
+			continue
+		}
+
+		c, ok := conns[frame.ConnectionNum]
+		if !ok {
+			c, e = net.Dial("tcp", p.Target)
+			if e != nil {
+				return e
+			}
+			conns[frame.ConnectionNum] = c
+		}
+
+		if _, e := c.Write(frame.MsgHeader); e != nil {
+			return e
+		}
+		if _, e := c.Write(frame.Body); e != nil {
+			return e
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package mongoproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+)
+
+// LoadServerTLSConfig builds a Proxy.TLSConfig for terminating TLS from
+// clients, given a certificate/key pair. If clientCAFile is non-empty,
+// clients must present a certificate signed by it.
+func LoadServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, e := tls.LoadX509KeyPair(certFile, keyFile)
+	if e != nil {
+		return nil, e
+	}
+
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if clientCAFile != "" {
+		pool, e := loadCertPool(clientCAFile)
+		if e != nil {
+			return nil, e
+		}
+
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg, nil
+}
+
+// LoadUpstreamTLSConfig builds a Proxy.UpstreamTLSConfig for initiating
+// TLS to Remote. caFile, if non-empty, is a PEM bundle trusted in place
+// of the system roots (e.g. for a self-signed replica set); serverName
+// overrides the name verified against the upstream's certificate, for
+// SNI against hosts like Atlas where Remote isn't the cert's CN.
+func LoadUpstreamTLSConfig(caFile, serverName string) (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: serverName}
+
+	if caFile != "" {
+		pool, e := loadCertPool(caFile)
+		if e != nil {
+			return nil, e
+		}
+
+		cfg.RootCAs = pool
+	}
+
+	return cfg, nil
+}
+
+func loadCertPool(path string) (*x509.CertPool, error) {
+	b, e := os.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.New("mongoproxy: no certificates found in " + path)
+	}
+
+	return pool, nil
+}
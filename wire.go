@@ -3,8 +3,13 @@ package mongoproxy
 import (
 	"bufio"
 	"bytes"
+	"compress/zlib"
 	"encoding/binary"
 	"errors"
+	"hash/crc32"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
 	"gopkg.in/mgo.v2/bson"
 	"io"
 	"reflect"
@@ -13,8 +18,10 @@ import (
 type Opcode int32
 
 const (
-	OP_REPLY = Opcode(1)
-	OP_MSG   = Opcode(1000)
+	OP_REPLY      = Opcode(1)
+	OP_MSG        = Opcode(1000) // legacy OP_MSG, deprecated since MongoDB 3.6
+	OP_COMPRESSED = Opcode(2012) // wraps another op in compressed form, see Compressed
+	OP_MSG_2013   = Opcode(2013) // modern OP_MSG used by 3.6+ drivers, see OpMsg
 )
 
 const (
@@ -32,7 +39,14 @@ const (
 	HEADER_SIZE = 16
 )
 
-//ERRORS
+// maxMessageSize bounds lengths read off the wire before they're used to
+// size an allocation (e.g. OP_COMPRESSED's compressed/uncompressed
+// sizes), mirroring MongoDB's own maxMessageSizeBytes default so a
+// corrupt or hostile header can't make readCompressed try to allocate an
+// arbitrary (or negative) amount of memory.
+const maxMessageSize = 48000000
+
+// ERRORS
 var (
 	ErrorWrongLen      error = errors.New("Wrong data length")
 	ErrorOpcodeUnknown error = errors.New("OP Code unknown")
@@ -130,6 +144,8 @@ func writeBson(data bson.D, w *bufio.Writer) error {
 
 func (o Opcode) String() string {
 	switch o {
+	case OP_COMPRESSED:
+		return "OP_COMPRESSED"
 	case OP_DELETE:
 		return "OP_DELETE"
 	case OP_GET_MORE:
@@ -140,6 +156,8 @@ func (o Opcode) String() string {
 		return "OP_KILL_CURSORS"
 	case OP_MSG:
 		return "OP_MSG"
+	case OP_MSG_2013:
+		return "OP_MSG_2013"
 	case OP_QUERY:
 		return "OP_QUERY"
 	case OP_REPLY:
@@ -153,6 +171,7 @@ func (o Opcode) String() string {
 
 type RequestMsg interface {
 	GetOp() Opcode
+	GetHeader() *MsgHeader
 }
 
 type Query struct {
@@ -171,6 +190,10 @@ func (req *Query) GetOp() Opcode {
 	return OP_QUERY
 }
 
+func (req *Query) GetHeader() *MsgHeader {
+	return req.MsgHeader
+}
+
 type Update struct {
 	*MsgHeader                // standard message header
 	ZERO               int32  // 0 - reserved for future use
@@ -184,6 +207,10 @@ func (req *Update) GetOp() Opcode {
 	return OP_UPDATE
 }
 
+func (req *Update) GetHeader() *MsgHeader {
+	return req.MsgHeader
+}
+
 type Insert struct {
 	*MsgHeader                  // standard message header
 	Flags              int32    // bit vector - see below
@@ -195,6 +222,10 @@ func (req *Insert) GetOp() Opcode {
 	return OP_INSERT
 }
 
+func (req *Insert) GetHeader() *MsgHeader {
+	return req.MsgHeader
+}
+
 type GetMore struct {
 	*MsgHeader                // standard message header
 	ZERO               int32  // 0 - reserved for future use
@@ -207,6 +238,10 @@ func (req *GetMore) GetOp() Opcode {
 	return OP_GET_MORE
 }
 
+func (req *GetMore) GetHeader() *MsgHeader {
+	return req.MsgHeader
+}
+
 type Delete struct {
 	*MsgHeader                // standard message header
 	ZERO               int32  // 0 - reserved for future use
@@ -219,6 +254,10 @@ func (req *Delete) GetOp() Opcode {
 	return OP_DELETE
 }
 
+func (req *Delete) GetHeader() *MsgHeader {
+	return req.MsgHeader
+}
+
 type KillCursors struct {
 	*MsgHeader                // standard message header
 	ZERO              int32   // 0 - reserved for future use
@@ -230,6 +269,10 @@ func (req *KillCursors) GetOp() Opcode {
 	return OP_KILL_CURSORS
 }
 
+func (req *KillCursors) GetHeader() *MsgHeader {
+	return req.MsgHeader
+}
+
 type Msg struct {
 	*MsgHeader        // standard message header
 	Message    string // message for the database
@@ -239,6 +282,81 @@ func (req *Msg) GetOp() Opcode {
 	return OP_MSG
 }
 
+func (req *Msg) GetHeader() *MsgHeader {
+	return req.MsgHeader
+}
+
+// Section is one chunk of an OP_MSG (opcode 2013) payload, either a
+// BodySection (kind 0) or a DocSequenceSection (kind 1). Kind 2 sections
+// are reserved for internal server use and are not supported here.
+type Section interface {
+	Kind() byte
+}
+
+// BodySection is kind 0: the single BSON document making up the command.
+type BodySection struct {
+	Document bson.D
+}
+
+func (s BodySection) Kind() byte { return 0 }
+
+// DocSequenceSection is kind 1: a named sequence of BSON documents carried
+// outside the body, e.g. the "documents" of an insert or "updates" of an
+// update.
+type DocSequenceSection struct {
+	Identifier string
+	Documents  []bson.D
+}
+
+func (s DocSequenceSection) Kind() byte { return 1 }
+
+const opMsgChecksumPresent = 1 << 0 // flagBits bit 0: trailing CRC32C checksum present
+
+// OpMsg is the modern OP_MSG (opcode 2013) request used by MongoDB 3.6+
+// drivers. It supersedes the single-section legacy Msg (opcode 1000).
+type OpMsg struct {
+	*MsgHeader
+	FlagBits int32
+	Sections []Section
+	Checksum uint32 // only meaningful when FlagBits&opMsgChecksumPresent != 0
+}
+
+func (req *OpMsg) GetOp() Opcode {
+	return OP_MSG_2013
+}
+
+func (req *OpMsg) GetHeader() *MsgHeader {
+	return req.MsgHeader
+}
+
+// Command returns the logical command name and target database for this
+// OpMsg, peeked from the first key of its kind-0 body and that body's
+// "$db" field.
+func (req *OpMsg) Command() (name string, db string) {
+	for _, s := range req.Sections {
+		body, ok := s.(BodySection)
+		if !ok {
+			continue
+		}
+
+		if len(body.Document) > 0 {
+			name = body.Document[0].Name
+		}
+
+		for _, e := range body.Document {
+			if e.Name == "$db" {
+				if v, ok := e.Value.(string); ok {
+					db = v
+				}
+			}
+		}
+
+		return
+	}
+
+	return
+}
+
 type Reply struct {
 	*MsgHeader              // standard message header
 	ResponseFlags  int32    // bit vector - see details below
@@ -252,9 +370,47 @@ func (req *Reply) GetOp() Opcode {
 	return OP_REPLY
 }
 
+func (req *Reply) GetHeader() *MsgHeader {
+	return req.MsgHeader
+}
+
+// CompressorID identifies the wire-protocol compression algorithm
+// negotiated during the `hello`/`isMaster` handshake.
+type CompressorID uint8
+
+const (
+	CompressorNoop   CompressorID = 0
+	CompressorSnappy CompressorID = 1
+	CompressorZlib   CompressorID = 2
+	CompressorZstd   CompressorID = 3
+)
+
+// Compressed is the OP_COMPRESSED (opcode 2012) wrapper drivers use once
+// they've negotiated compression. ReadRequest transparently decompresses
+// it and recursively parses Inner, so callers that don't care about
+// compression can just look at Inner; WriteRequest re-compresses Inner
+// with the same CompressorID when forwarding upstream.
+type Compressed struct {
+	*MsgHeader
+	OriginalOpcode   Opcode
+	UncompressedSize int32
+	CompressorID     CompressorID
+	Inner            RequestMsg
+}
+
+func (req *Compressed) GetOp() Opcode {
+	return OP_COMPRESSED
+}
+
+func (req *Compressed) GetHeader() *MsgHeader {
+	return req.MsgHeader
+}
+
 func newReq(h *MsgHeader) RequestMsg {
 	var ret RequestMsg
 	switch h.Opcode {
+	case OP_COMPRESSED:
+		ret = &Compressed{MsgHeader: h}
 	case OP_UPDATE:
 		ret = &Update{MsgHeader: h}
 	case OP_QUERY:
@@ -269,6 +425,8 @@ func newReq(h *MsgHeader) RequestMsg {
 		ret = &KillCursors{MsgHeader: h}
 	case OP_MSG:
 		ret = &Msg{MsgHeader: h}
+	case OP_MSG_2013:
+		ret = &OpMsg{MsgHeader: h}
 	case OP_REPLY:
 		ret = &Reply{MsgHeader: h}
 	}
@@ -282,11 +440,27 @@ func ReadRequest(r io.Reader) (RequestMsg, error) {
 		return nil, e
 	}
 
+	return parseOp(h, r)
+}
+
+// parseOp parses the body of the op described by h from r. It is split out
+// from ReadRequest so that readCompressed can recursively parse the inner
+// op carried by an OP_COMPRESSED message, which has no header of its own on
+// the wire.
+func parseOp(h *MsgHeader, r io.Reader) (RequestMsg, error) {
 	req := newReq(h)
 	if req == nil {
 		return nil, ErrorOpcodeUnknown
 	}
 
+	if opMsg, ok := req.(*OpMsg); ok {
+		return readOpMsg(opMsg, r)
+	}
+
+	if compressed, ok := req.(*Compressed); ok {
+		return readCompressed(compressed, r)
+	}
+
 	bytesRead := HEADER_SIZE
 	bufferReader := bufio.NewReader(r)
 
@@ -376,10 +550,358 @@ func ReadRequest(r io.Reader) (RequestMsg, error) {
 	return req, nil
 }
 
-func WriteRequest(req RequestMsg, w io.Writer) error {
+// readOpMsg parses the body of an OP_MSG (opcode 2013): a flagBits header,
+// a stream of sections filling out the rest of the message, and an
+// optional trailing CRC32C checksum when the checksum-present bit is set.
+// The section stream doesn't fit the generic reflect-driven loop in
+// parseOp because a section's shape depends on a leading kind byte,
+// so it's parsed by hand here.
+func readOpMsg(req *OpMsg, r io.Reader) (*OpMsg, error) {
+	bufferReader := bufio.NewReader(r)
+	bytesRead := HEADER_SIZE
+
+	flagBits, e := readInt32s(bufferReader, 1)
+	if e != nil {
+		return nil, e
+	}
+	req.FlagBits = flagBits[0]
+	bytesRead += 4
+
+	checksumPresent := req.FlagBits&opMsgChecksumPresent != 0
+	trailer := 0
+	if checksumPresent {
+		trailer = 4
+	}
+
+	for bytesRead < int(req.MessageLength)-trailer {
+		kind, e := bufferReader.ReadByte()
+		if e != nil {
+			return nil, e
+		}
+		bytesRead++
+
+		switch kind {
+		case 0:
+			doc, n, e := readDoc(bufferReader)
+			if e != nil {
+				return nil, e
+			}
+			req.Sections = append(req.Sections, BodySection{Document: doc})
+			bytesRead += n
+		case 1:
+			sizeBuf, e := readInt32s(bufferReader, 1)
+			if e != nil {
+				return nil, e
+			}
+			bytesRead += 4
+			seqEnd := bytesRead + int(sizeBuf[0]) - 4
+
+			id, e := bufferReader.ReadString(byte(0))
+			if e != nil {
+				return nil, e
+			}
+			id = id[:len(id)-1] //Exclude \x00
+			bytesRead += len(id) + 1
+
+			var docs []bson.D
+			for bytesRead < seqEnd {
+				doc, n, e := readDoc(bufferReader)
+				if e != nil {
+					return nil, e
+				}
+				docs = append(docs, doc)
+				bytesRead += n
+			}
+			req.Sections = append(req.Sections, DocSequenceSection{Identifier: id, Documents: docs})
+		default:
+			return nil, ErrorOpcodeUnknown
+		}
+	}
+
+	if checksumPresent {
+		sum, e := readInt32s(bufferReader, 1)
+		if e != nil {
+			return nil, e
+		}
+		req.Checksum = uint32(sum[0])
+	}
+
+	return req, nil
+}
+
+// writeOpMsg is the WriteRequest counterpart of readOpMsg.
+// writeOpMsg serializes req's sections first so it can recompute
+// MessageLength from their actual size -- callers building a fresh OpMsg
+// (e.g. package auth's saslStart/saslContinue) don't have to hand-compute
+// wire lengths themselves.
+func writeOpMsg(req *OpMsg, w io.Writer) error {
+	var body bytes.Buffer
+
+	e := binary.Write(&body, binary.LittleEndian, req.FlagBits)
+	if e != nil {
+		return e
+	}
+
+	for _, s := range req.Sections {
+		switch sec := s.(type) {
+		case BodySection:
+			e = body.WriteByte(0)
+			if e == nil {
+				bodyBufWriter := bufio.NewWriter(&body)
+				if e = writeBson(sec.Document, bodyBufWriter); e == nil {
+					e = bodyBufWriter.Flush()
+				}
+			}
+		case DocSequenceSection:
+			var seq bytes.Buffer
+			seq.WriteString(sec.Identifier)
+			seq.WriteByte(0)
+
+			for _, d := range sec.Documents {
+				b, berr := bson.Marshal(d)
+				if berr != nil {
+					e = berr
+					break
+				}
+				seq.Write(b)
+			}
+
+			if e == nil {
+				e = body.WriteByte(1)
+			}
+			if e == nil {
+				e = binary.Write(&body, binary.LittleEndian, int32(4+seq.Len()))
+			}
+			if e == nil {
+				_, e = body.Write(seq.Bytes())
+			}
+		default:
+			e = ErrorOpcodeUnknown
+		}
+
+		if e != nil {
+			return e
+		}
+	}
+
+	checksumPresent := req.FlagBits&opMsgChecksumPresent != 0
+	trailer := 0
+	if checksumPresent {
+		trailer = 4
+	}
+
+	req.Opcode = OP_MSG_2013
+	req.MessageLength = int32(HEADER_SIZE + body.Len() + trailer)
+
+	if checksumPresent {
+		// The checksum covers the header and body as they'll actually go
+		// out on the wire, so it's computed here (after MessageLength is
+		// final) instead of trusting whatever req.Checksum was last set
+		// to -- otherwise a body rewritten in place after checksumming
+		// (e.g. by interceptor.Rewrite) would forward a stale CRC.
+		var headerBuf bytes.Buffer
+		if e := binary.Write(&headerBuf, binary.LittleEndian, *req.MsgHeader); e != nil {
+			return e
+		}
+
+		table := crc32.MakeTable(crc32.Castagnoli)
+		sum := crc32.Checksum(headerBuf.Bytes(), table)
+		sum = crc32.Update(sum, table, body.Bytes())
+		req.Checksum = sum
+
+		if e := binary.Write(&body, binary.LittleEndian, req.Checksum); e != nil {
+			return e
+		}
+	}
+
+	bufWriter := bufio.NewWriter(w)
+	defer bufWriter.Flush()
+
+	if e := binary.Write(bufWriter, binary.LittleEndian, *req.MsgHeader); e != nil {
+		return e
+	}
+
+	_, e = bufWriter.Write(body.Bytes())
+	return e
+}
+
+// decompress inflates data using the negotiated compressor.
+func decompress(id CompressorID, data []byte) ([]byte, error) {
+	switch id {
+	case CompressorNoop:
+		return data, nil
+	case CompressorSnappy:
+		return snappy.Decode(nil, data)
+	case CompressorZlib:
+		zr, e := zlib.NewReader(bytes.NewReader(data))
+		if e != nil {
+			return nil, e
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	case CompressorZstd:
+		zr, e := zstd.NewReader(bytes.NewReader(data))
+		if e != nil {
+			return nil, e
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	}
+
+	return nil, ErrorOpcodeUnknown
+}
+
+// compress deflates data using the given compressor, the inverse of decompress.
+func compress(id CompressorID, data []byte) ([]byte, error) {
+	switch id {
+	case CompressorNoop:
+		return data, nil
+	case CompressorSnappy:
+		return snappy.Encode(nil, data), nil
+	case CompressorZlib:
+		var buf bytes.Buffer
+		zw := zlib.NewWriter(&buf)
+		if _, e := zw.Write(data); e != nil {
+			return nil, e
+		}
+		if e := zw.Close(); e != nil {
+			return nil, e
+		}
+		return buf.Bytes(), nil
+	case CompressorZstd:
+		var buf bytes.Buffer
+		zw, e := zstd.NewWriter(&buf)
+		if e != nil {
+			return nil, e
+		}
+		if _, e := zw.Write(data); e != nil {
+			return nil, e
+		}
+		if e := zw.Close(); e != nil {
+			return nil, e
+		}
+		return buf.Bytes(), nil
+	}
+
+	return nil, ErrorOpcodeUnknown
+}
+
+// readCompressed decompresses an OP_COMPRESSED payload and recursively
+// parses the inner op it carries. The inner op has no MsgHeader of its own
+// on the wire, so one is synthesized from the outer header plus
+// originalOpcode/uncompressedSize.
+func readCompressed(req *Compressed, r io.Reader) (*Compressed, error) {
+	bufferReader := bufio.NewReader(r)
+
+	originalOpcode, e := readInt32s(bufferReader, 1)
+	if e != nil {
+		return nil, e
+	}
+	req.OriginalOpcode = Opcode(originalOpcode[0])
+
+	uncompressedSize, e := readInt32s(bufferReader, 1)
+	if e != nil {
+		return nil, e
+	}
+	req.UncompressedSize = uncompressedSize[0]
+
+	compressorID, e := bufferReader.ReadByte()
+	if e != nil {
+		return nil, e
+	}
+	req.CompressorID = CompressorID(compressorID)
+
+	if req.UncompressedSize < 0 || req.UncompressedSize > maxMessageSize {
+		return nil, ErrorWrongLen
+	}
+
+	compressedLen := int(req.MessageLength) - HEADER_SIZE - 4 - 4 - 1
+	if compressedLen < 0 || compressedLen > maxMessageSize {
+		return nil, ErrorWrongLen
+	}
+
+	compressedMessage := make([]byte, compressedLen)
+	if _, e := io.ReadFull(bufferReader, compressedMessage); e != nil {
+		return nil, e
+	}
+
+	uncompressed, e := decompress(req.CompressorID, compressedMessage)
+	if e != nil {
+		return nil, e
+	}
+
+	innerHeader := &MsgHeader{
+		MessageLength: HEADER_SIZE + req.UncompressedSize,
+		RequestID:     req.RequestID,
+		ResponseTo:    req.ResponseTo,
+		Opcode:        req.OriginalOpcode,
+	}
+
+	inner, e := parseOp(innerHeader, bytes.NewReader(uncompressed))
+	if e != nil {
+		return nil, e
+	}
+	req.Inner = inner
+
+	return req, nil
+}
+
+// writeCompressed re-serializes req.Inner and wraps it back up as an
+// OP_COMPRESSED message using req.CompressorID, the WriteRequest
+// counterpart of readCompressed.
+func writeCompressed(req *Compressed, w io.Writer) error {
+	var innerBuf bytes.Buffer
+	if e := WriteRequest(req.Inner, &innerBuf); e != nil {
+		return e
+	}
+	uncompressed := innerBuf.Bytes()[HEADER_SIZE:]
+
+	compressedMessage, e := compress(req.CompressorID, uncompressed)
+	if e != nil {
+		return e
+	}
+
+	req.OriginalOpcode = req.Inner.GetOp()
+	req.UncompressedSize = int32(len(uncompressed))
+	req.Opcode = OP_COMPRESSED
+	req.MessageLength = int32(HEADER_SIZE + 4 + 4 + 1 + len(compressedMessage))
+
 	bufWriter := bufio.NewWriter(w)
 	defer bufWriter.Flush()
 
+	if e := binary.Write(bufWriter, binary.LittleEndian, *req.MsgHeader); e != nil {
+		return e
+	}
+	if e := binary.Write(bufWriter, binary.LittleEndian, int32(req.OriginalOpcode)); e != nil {
+		return e
+	}
+	if e := binary.Write(bufWriter, binary.LittleEndian, req.UncompressedSize); e != nil {
+		return e
+	}
+	if e := bufWriter.WriteByte(byte(req.CompressorID)); e != nil {
+		return e
+	}
+	_, e = bufWriter.Write(compressedMessage)
+	return e
+}
+
+func WriteRequest(req RequestMsg, w io.Writer) error {
+	if compressed, ok := req.(*Compressed); ok {
+		return writeCompressed(compressed, w)
+	}
+
+	if opMsg, ok := req.(*OpMsg); ok {
+		return writeOpMsg(opMsg, w)
+	}
+
+	// The body is serialized into its own buffer first, separately from
+	// the header field below, so MessageLength can be recomputed from its
+	// actual size instead of trusting whatever the caller last set it to
+	// -- callers like interceptor.Rewrite mutate a request's documents in
+	// place, which changes its serialized length.
+	var body bytes.Buffer
+	var header reflect.Value
+
 	v := reflect.ValueOf(req)
 	v = v.Elem()
 
@@ -389,19 +911,25 @@ func WriteRequest(req RequestMsg, w io.Writer) error {
 		t := f.Type()
 		switch {
 		case t == reflect.TypeOf((*MsgHeader)(nil)):
-			e = binary.Write(bufWriter, binary.LittleEndian, f.Elem().Interface())
+			header = f
 		case t.Kind() == reflect.Int32, t.Kind() == reflect.Int64:
-			e = binary.Write(bufWriter, binary.LittleEndian, f.Interface())
+			e = binary.Write(&body, binary.LittleEndian, f.Interface())
 		case t.Kind() == reflect.String:
-			_, e = bufWriter.WriteString(f.String())
-			bufWriter.WriteByte(0) //Terminate with \x00
+			_, e = body.WriteString(f.String())
+			body.WriteByte(0) //Terminate with \x00
 		case t == reflect.TypeOf((bson.D)(nil)):
-			e = writeBson(f.Interface().(bson.D), bufWriter)
+			bodyBufWriter := bufio.NewWriter(&body)
+			if e = writeBson(f.Interface().(bson.D), bodyBufWriter); e == nil {
+				e = bodyBufWriter.Flush()
+			}
 		case t == reflect.TypeOf(([]bson.D)(nil)):
 			data := f.Interface().([]bson.D)
 
 			for _, d := range data {
-				e = writeBson(d, bufWriter)
+				bodyBufWriter := bufio.NewWriter(&body)
+				if e = writeBson(d, bodyBufWriter); e == nil {
+					e = bodyBufWriter.Flush()
+				}
 
 				if e != nil {
 					break
@@ -410,15 +938,33 @@ func WriteRequest(req RequestMsg, w io.Writer) error {
 		case t == reflect.TypeOf(([]int64)(nil)):
 			data := f.Interface().([]int64)
 			for _, d := range data {
-				e = binary.Write(bufWriter, binary.LittleEndian, d)
+				e = binary.Write(&body, binary.LittleEndian, d)
 
 				if e != nil {
 					break
 				}
 			}
 		}
+
+		if e != nil {
+			return e
+		}
+	}
+
+	if header.IsValid() && !header.IsNil() {
+		header.Elem().FieldByName("MessageLength").SetInt(int64(HEADER_SIZE + body.Len()))
+	}
+
+	bufWriter := bufio.NewWriter(w)
+	defer bufWriter.Flush()
+
+	if header.IsValid() {
+		if e := binary.Write(bufWriter, binary.LittleEndian, header.Elem().Interface()); e != nil {
+			return e
+		}
 	}
 
+	_, e = bufWriter.Write(body.Bytes())
 	if e != nil {
 		return e
 	}
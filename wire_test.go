@@ -0,0 +1,228 @@
+package mongoproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// TestWriteReadRequestRoundTrip exercises WriteRequest/ReadRequest for the
+// legacy opcodes that go through the generic reflect-based path, plus the
+// modern OP_MSG_2013 path, making sure what comes back out matches what
+// went in -- in particular that MessageLength is always recomputed from
+// the actual serialized size rather than trusted from the caller.
+func TestWriteReadRequestRoundTrip(t *testing.T) {
+	cases := []struct {
+		name string
+		req  RequestMsg
+		want func(t *testing.T, got RequestMsg)
+	}{
+		{
+			name: "Query",
+			req: &Query{
+				MsgHeader:          &MsgHeader{RequestID: 42, Opcode: OP_QUERY},
+				FullCollectionName: "test.coll",
+				NumberToReturn:     1,
+				Query:              bson.D{{Name: "ping", Value: 1}},
+			},
+			want: func(t *testing.T, got RequestMsg) {
+				q, ok := got.(*Query)
+				if !ok {
+					t.Fatalf("got %T, want *Query", got)
+				}
+				if q.FullCollectionName != "test.coll" {
+					t.Errorf("FullCollectionName = %q", q.FullCollectionName)
+				}
+				if len(q.Query) != 1 || q.Query[0].Name != "ping" {
+					t.Errorf("Query = %v", q.Query)
+				}
+			},
+		},
+		{
+			name: "Insert",
+			req: &Insert{
+				MsgHeader:          &MsgHeader{RequestID: 7, Opcode: OP_INSERT},
+				FullCollectionName: "test.coll",
+				Documents: []bson.D{
+					{{Name: "_id", Value: 1}},
+					{{Name: "_id", Value: 2}},
+				},
+			},
+			want: func(t *testing.T, got RequestMsg) {
+				ins, ok := got.(*Insert)
+				if !ok {
+					t.Fatalf("got %T, want *Insert", got)
+				}
+				if len(ins.Documents) != 2 {
+					t.Fatalf("got %d documents, want 2", len(ins.Documents))
+				}
+				if ins.Documents[1][0].Value != 2 {
+					t.Errorf("Documents[1] = %v", ins.Documents[1])
+				}
+			},
+		},
+		{
+			name: "OpMsg",
+			req: &OpMsg{
+				MsgHeader: &MsgHeader{RequestID: 99, Opcode: OP_MSG_2013},
+				Sections: []Section{
+					BodySection{Document: bson.D{
+						{Name: "ping", Value: 1},
+						{Name: "$db", Value: "test"},
+					}},
+				},
+			},
+			want: func(t *testing.T, got RequestMsg) {
+				m, ok := got.(*OpMsg)
+				if !ok {
+					t.Fatalf("got %T, want *OpMsg", got)
+				}
+				name, db := m.Command()
+				if name != "ping" || db != "test" {
+					t.Errorf("Command() = %q, %q", name, db)
+				}
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if e := WriteRequest(c.req, &buf); e != nil {
+				t.Fatalf("WriteRequest: %v", e)
+			}
+
+			var length int32
+			binary.Read(bytes.NewReader(buf.Bytes()[:4]), binary.LittleEndian, &length)
+			if int(length) != buf.Len() {
+				t.Fatalf("MessageLength = %d, actual wire length = %d", length, buf.Len())
+			}
+
+			got, e := ReadRequest(&buf)
+			if e != nil {
+				t.Fatalf("ReadRequest: %v", e)
+			}
+			c.want(t, got)
+		})
+	}
+}
+
+// TestWriteRequestRecomputesLengthAfterMutation guards against the bug
+// where an interceptor grows a request's body in place (e.g. Rewrite
+// injecting maxTimeMS) and WriteRequest's generic path wrote the stale
+// MessageLength the caller had set, corrupting the framing of every
+// message after it on the connection.
+func TestWriteRequestRecomputesLengthAfterMutation(t *testing.T) {
+	q := &Query{
+		MsgHeader:          &MsgHeader{RequestID: 1, Opcode: OP_QUERY},
+		FullCollectionName: "test.coll",
+		Query:              bson.D{{Name: "ping", Value: 1}},
+	}
+
+	// Simulate an interceptor growing the body after MessageLength would
+	// otherwise have been fixed by an earlier, smaller serialization.
+	q.MessageLength = HEADER_SIZE + 1
+	q.Query = append(q.Query, bson.DocElem{Name: "$readPreference", Value: bson.D{{Name: "mode", Value: "secondary"}}})
+
+	var buf bytes.Buffer
+	if e := WriteRequest(q, &buf); e != nil {
+		t.Fatalf("WriteRequest: %v", e)
+	}
+
+	var length int32
+	binary.Read(bytes.NewReader(buf.Bytes()[:4]), binary.LittleEndian, &length)
+	if int(length) != buf.Len() {
+		t.Fatalf("MessageLength = %d, actual wire length = %d", length, buf.Len())
+	}
+
+	if _, e := ReadRequest(&buf); e != nil {
+		t.Fatalf("ReadRequest of recomputed message: %v", e)
+	}
+}
+
+// TestCompressedRoundTrip exercises OP_COMPRESSED (opcode 2012): wrapping
+// a Query, writing it, and reading it back should transparently
+// decompress and recursively parse Inner.
+func TestCompressedRoundTrip(t *testing.T) {
+	inner := &Query{
+		MsgHeader:          &MsgHeader{RequestID: 5, Opcode: OP_QUERY},
+		FullCollectionName: "test.coll",
+		Query:              bson.D{{Name: "ping", Value: 1}},
+	}
+
+	compressed := &Compressed{
+		MsgHeader:    &MsgHeader{RequestID: 5, Opcode: OP_COMPRESSED},
+		CompressorID: CompressorNoop,
+		Inner:        inner,
+	}
+
+	var buf bytes.Buffer
+	if e := WriteRequest(compressed, &buf); e != nil {
+		t.Fatalf("WriteRequest: %v", e)
+	}
+
+	got, e := ReadRequest(&buf)
+	if e != nil {
+		t.Fatalf("ReadRequest: %v", e)
+	}
+
+	gotCompressed, ok := got.(*Compressed)
+	if !ok {
+		t.Fatalf("got %T, want *Compressed", got)
+	}
+
+	gotQuery, ok := gotCompressed.Inner.(*Query)
+	if !ok {
+		t.Fatalf("Inner = %T, want *Query", gotCompressed.Inner)
+	}
+	if gotQuery.FullCollectionName != "test.coll" {
+		t.Errorf("FullCollectionName = %q", gotQuery.FullCollectionName)
+	}
+}
+
+// TestReadCompressedRejectsBadLength is a regression test for a remote DoS:
+// a header whose MessageLength implies a negative compressed payload
+// length used to reach make([]byte, compressedLen) unchecked and panic.
+// It must now return ErrorWrongLen instead.
+func TestReadCompressedRejectsBadLength(t *testing.T) {
+	var buf bytes.Buffer
+
+	header := MsgHeader{
+		MessageLength: HEADER_SIZE, // too short to hold originalOpcode/uncompressedSize/compressorID
+		RequestID:     1,
+		Opcode:        OP_COMPRESSED,
+	}
+	binary.Write(&buf, binary.LittleEndian, header)
+	binary.Write(&buf, binary.LittleEndian, int32(OP_QUERY)) // originalOpcode
+	binary.Write(&buf, binary.LittleEndian, int32(0))        // uncompressedSize
+	buf.WriteByte(byte(CompressorNoop))
+
+	_, e := ReadRequest(&buf)
+	if e != ErrorWrongLen {
+		t.Fatalf("got err %v, want ErrorWrongLen", e)
+	}
+}
+
+// TestReadCompressedRejectsOversizedUncompressedSize guards the other
+// bound readCompressed added: an UncompressedSize larger than
+// maxMessageSize must also be rejected rather than trusted.
+func TestReadCompressedRejectsOversizedUncompressedSize(t *testing.T) {
+	var buf bytes.Buffer
+
+	header := MsgHeader{
+		MessageLength: HEADER_SIZE + 4 + 4 + 1,
+		RequestID:     1,
+		Opcode:        OP_COMPRESSED,
+	}
+	binary.Write(&buf, binary.LittleEndian, header)
+	binary.Write(&buf, binary.LittleEndian, int32(OP_QUERY))
+	binary.Write(&buf, binary.LittleEndian, int32(maxMessageSize+1))
+	buf.WriteByte(byte(CompressorNoop))
+
+	_, e := ReadRequest(&buf)
+	if e != ErrorWrongLen {
+		t.Fatalf("got err %v, want ErrorWrongLen", e)
+	}
+}